@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dsAdapter finds the metadata of a cloud-init datasource in the ds
+// section of the instance data and normalizes it to the ds.meta_data
+// layout decoded by decodeDS.  Adapters must not modify ds, which is
+// shared with other readers of the snapshot; errors are reported under
+// ds.meta_data, where handlers look for them.
+type dsAdapter func(d *metadataDecoder, ds map[string]interface{}) map[string]interface{}
+
+// dsAdapters maps v1.cloud_name and v1.platform values to the adapter for
+// their layout.  Anything else is read from ds.meta_data as is.
+var dsAdapters = map[string]dsAdapter{
+	"nocloud":     metaDataAdapter,
+	"nocloud-net": metaDataAdapter,
+	"lxd":         lxdAdapter,
+	"vmware":      vmwareAdapter,
+	"openstack":   openStackAdapter,
+	"configdrive": openStackAdapter,
+	"proxmox":     proxmoxAdapter,
+}
+
+const dsMetaDataPath = "ds.meta_data"
+
+// dsAdapterFor picks the adapter by cloud name first, as it may be set
+// explicitly in the metadata (cloud-name), and by platform otherwise.
+func dsAdapterFor(v1 v1Metadata) dsAdapter {
+	for _, name := range []string{v1.CloudName, v1.Platform} {
+		if adapter, ok := dsAdapters[strings.ToLower(name)]; ok {
+			return adapter
+		}
+	}
+	return metaDataAdapter
+}
+
+// metaDataAdapter reads ds.meta_data, where NoCloud and most other
+// datasources keep the parsed meta-data document.
+func metaDataAdapter(d *metadataDecoder, ds map[string]interface{}) map[string]interface{} {
+	return d.object(ds, "ds", "meta_data", true)
+}
+
+// withDefaults returns a copy of fields with each of defaults added
+// unless fields already has a value under that key.
+func withDefaults(fields map[string]interface{}, defaults map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(fields)+len(defaults))
+	for k, v := range fields {
+		result[k] = v
+	}
+	for k, v := range defaults {
+		if v == nil {
+			continue
+		}
+		if _, found := lookupField(result, k); !found {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// lxdReservedKeys are the user.* instance config keys that LXD passes to
+// cloud-init for its own use.
+var lxdReservedKeys = map[string]bool{
+	"user.meta-data":      true,
+	"user.user-data":      true,
+	"user.vendor-data":    true,
+	"user.network-config": true,
+}
+
+// lxdAdapter reads the LXD datasource, which keeps the meta-data served
+// by the LXD agent (including user.meta-data) as a YAML string in
+// ds.meta-data.  The remaining user.* keys of the instance configuration,
+// found in ds.config, become tags.
+func lxdAdapter(d *metadataDecoder, ds map[string]interface{}) map[string]interface{} {
+	// Not looked up with lookupField, which would find ds.meta-data.
+	fields, _ := ds["meta_data"].(map[string]interface{})
+
+	switch raw := ds["meta-data"].(type) {
+	case nil:
+	case string:
+		var parsed map[string]interface{}
+		if err := yaml.Unmarshal([]byte(raw), &parsed); err != nil {
+			d.fail(dsMetaDataPath, fmt.Sprintf("cannot be parsed from LXD meta-data: %v", err))
+			return nil
+		}
+		fields = withDefaults(parsed, fields)
+	default:
+		d.fail(dsMetaDataPath, "cannot be parsed from LXD meta-data: value is not a string")
+		return nil
+	}
+	if fields == nil {
+		d.fail(dsMetaDataPath, "is missing in metadata")
+		return nil
+	}
+
+	config, _ := ds["config"].(map[string]interface{})
+	tags := map[string]interface{}{}
+	for key, val := range config {
+		if !strings.HasPrefix(key, "user.") || lxdReservedKeys[key] {
+			continue
+		}
+		tags[strings.TrimPrefix(key, "user.")] = val
+	}
+	if len(tags) == 0 {
+		return fields
+	}
+	if existing, ok := fields["tags"].(map[string]interface{}); ok {
+		tags = withDefaults(existing, tags)
+	} else if _, found := fields["tags"]; found {
+		// Leave malformed tags for decodeDS to report.
+		return fields
+	}
+	return withDefaults(map[string]interface{}{"tags": tags}, fields)
+}
+
+// vmwareAdapter reads the VMware datasource, whose guestinfo.metadata
+// document is kept in ds.meta_data.  Guest customization sets hostname
+// rather than local-hostname.
+func vmwareAdapter(d *metadataDecoder, ds map[string]interface{}) map[string]interface{} {
+	md := d.object(ds, "ds", "meta_data", true)
+	if md == nil {
+		return nil
+	}
+	return withDefaults(md, map[string]interface{}{
+		"local_hostname": md["hostname"],
+	})
+}
+
+// openStackAdapter reads the OpenStack and ConfigDrive datasources.  The
+// user metadata of the server (meta) becomes the tags, the hostname comes
+// from hostname and the instance type from the flavor in the EC2-style
+// metadata, if the cloud serves it.
+func openStackAdapter(d *metadataDecoder, ds map[string]interface{}) map[string]interface{} {
+	md := d.object(ds, "ds", "meta_data", true)
+	if md == nil {
+		return nil
+	}
+	defaults := map[string]interface{}{
+		"local_hostname": md["hostname"],
+		"tags":           md["meta"],
+	}
+	if ec2, ok := ds["ec2_metadata"].(map[string]interface{}); ok {
+		defaults["instance_type"] = ec2["instance-type"]
+	}
+	return withDefaults(md, defaults)
+}
+
+// proxmoxAdapter reads metadata generated by Proxmox VE.  cloud-init
+// reports its seeds under the nocloud or openstack platform, depending on
+// the VM's cloud-init type, and as the proxmox cloud when the meta-data
+// (usually a cicustom snippet) sets cloud-name: proxmox.  The OpenStack
+// adapter handles both layouts.  Proxmox VM tags are labels without
+// values, written as a string separated by semicolons, commas or spaces;
+// each becomes a tag with an empty value.
+func proxmoxAdapter(d *metadataDecoder, ds map[string]interface{}) map[string]interface{} {
+	md := openStackAdapter(d, ds)
+	labels, ok := md["tags"].(string)
+	if !ok {
+		return md
+	}
+
+	tags := map[string]interface{}{}
+	for _, label := range strings.FieldsFunc(labels, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	}) {
+		tags[label] = ""
+	}
+	return withDefaults(map[string]interface{}{"tags": tags}, md)
+}
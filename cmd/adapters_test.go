@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testV1(platform, cloudName string) map[string]interface{} {
+	return map[string]interface{}{
+		"instance_id":       "i-test-1234",
+		"region":            "us-west-2",
+		"availability_zone": "us-west-2a",
+		"machine":           "x86_64",
+		"distro":            "debian",
+		"distro_release":    "bookworm",
+		"platform":          platform,
+		"cloud_name":        cloudName,
+	}
+}
+
+func TestDSAdapters(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]interface{}
+		hostname string
+		instType string
+		tags     map[string]string
+	}{
+		{
+			name: "nocloud",
+			data: map[string]interface{}{
+				"v1": testV1("nocloud", "nocloud"),
+				"ds": map[string]interface{}{
+					"meta_data": map[string]interface{}{
+						"instance-id":    "iid-1",
+						"local-hostname": "vm1",
+						"instance-type":  "m5.large",
+						"tags":           map[string]interface{}{"Team": "infra"},
+					},
+				},
+			},
+			hostname: "vm1",
+			instType: "m5.large",
+			tags:     map[string]string{"Team": "infra"},
+		},
+		{
+			name: "lxd",
+			data: map[string]interface{}{
+				"v1": testV1("lxd", "lxd"),
+				"ds": map[string]interface{}{
+					"_metadata_api_version": "1.0",
+					"config": map[string]interface{}{
+						"user.Team":      "infra",
+						"user.meta-data": "instance_type: c5.xlarge",
+						"cloud-init.x":   "ignored",
+					},
+					"meta-data": "#cloud-config\ninstance-id: c1\nlocal-hostname: c1\ninstance_type: c5.xlarge\n",
+				},
+			},
+			hostname: "c1",
+			instType: "c5.xlarge",
+			tags:     map[string]string{"Team": "infra"},
+		},
+		{
+			name: "vmware",
+			data: map[string]interface{}{
+				"v1": testV1("vmware", "vmware"),
+				"ds": map[string]interface{}{
+					"meta_data": map[string]interface{}{
+						"instance-id": "vm-42",
+						"hostname":    "esx-vm",
+					},
+				},
+			},
+			hostname: "esx-vm",
+			instType: "t2.micro",
+		},
+		{
+			name: "openstack",
+			data: map[string]interface{}{
+				"v1": testV1("openstack", "openstack"),
+				"ds": map[string]interface{}{
+					"meta_data": map[string]interface{}{
+						"uuid":     "4b5e6d0c",
+						"hostname": "os-vm.novalocal",
+						"meta":     map[string]interface{}{"Team": "infra"},
+					},
+					"ec2_metadata": map[string]interface{}{
+						"instance-type": "m1.small",
+					},
+				},
+			},
+			hostname: "os-vm.novalocal",
+			instType: "m1.small",
+			tags:     map[string]string{"Team": "infra"},
+		},
+	}
+	for _, tt := range tests {
+		md := decodeInstanceData(tt.data)
+		if err := md.check("ds.meta_data.local_hostname", "ds.meta_data.tags"); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if md.DS.LocalHostname != tt.hostname {
+			t.Errorf("%s: expected hostname %q, got %q", tt.name, tt.hostname, md.DS.LocalHostname)
+		}
+		if md.DS.InstanceType != tt.instType {
+			t.Errorf("%s: expected instance type %q, got %q", tt.name, tt.instType, md.DS.InstanceType)
+		}
+		if !reflect.DeepEqual(md.DS.Tags, tt.tags) {
+			t.Errorf("%s: expected tags %v, got %v", tt.name, tt.tags, md.DS.Tags)
+		}
+	}
+}
+
+// Instance data as cloud-init writes it for the seeds Proxmox VE
+// generates, with cloud-name set by a cicustom meta snippet.
+const (
+	proxmoxNoCloudInstanceData = `{
+ "_beta_keys": ["subplatform"],
+ "ds": {
+  "_doc": "EXPERIMENTAL: The structure and format of content scoped under the 'ds' key may change in subsequent releases of cloud-init.",
+  "meta_data": {
+   "cloud-name": "proxmox",
+   "instance-id": "2c1a9f0e6b3d8c4f5a7e9b0d1c2e3f4a5b6c7d8e",
+   "local-hostname": "pve-vm",
+   "tags": "prod;web"
+  }
+ },
+ "v1": {
+  "_beta_keys": ["subplatform"],
+  "availability_zone": null,
+  "cloud_name": "proxmox",
+  "distro": "debian",
+  "distro_release": "bookworm",
+  "instance_id": "2c1a9f0e6b3d8c4f5a7e9b0d1c2e3f4a5b6c7d8e",
+  "local_hostname": "pve-vm",
+  "machine": "x86_64",
+  "platform": "nocloud",
+  "region": null,
+  "subplatform": "config-disk (/dev/sr0)"
+ }
+}`
+	proxmoxConfigDriveInstanceData = `{
+ "ds": {
+  "_doc": "EXPERIMENTAL: The structure and format of content scoped under the 'ds' key may change in subsequent releases of cloud-init.",
+  "meta_data": {
+   "cloud-name": "proxmox",
+   "hostname": "pve-win",
+   "network_config": {"content_path": "/content/0000"},
+   "tags": "prod, web",
+   "uuid": "2c1a9f0e6b3d8c4f5a7e9b0d1c2e3f4a5b6c7d8e"
+  }
+ },
+ "v1": {
+  "availability_zone": null,
+  "cloud_name": "proxmox",
+  "instance_id": "2c1a9f0e6b3d8c4f5a7e9b0d1c2e3f4a5b6c7d8e",
+  "local_hostname": "pve-win",
+  "machine": "x86_64",
+  "platform": "openstack",
+  "region": null,
+  "subplatform": "seed-dir (/dev/sr0)"
+ }
+}`
+)
+
+func TestProxmoxAdapter(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		hostname string
+	}{
+		{"nocloud", proxmoxNoCloudInstanceData, "pve-vm"},
+		{"configdrive", proxmoxConfigDriveInstanceData, "pve-win"},
+	}
+	for _, tt := range tests {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+			t.Fatal(err)
+		}
+		md := decodeInstanceData(data)
+		if err := md.check("ds.meta_data.local_hostname", "ds.meta_data.tags"); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if md.DS.LocalHostname != tt.hostname {
+			t.Errorf("%s: expected hostname %q, got %q", tt.name, tt.hostname, md.DS.LocalHostname)
+		}
+		if want := map[string]string{"prod": "", "web": ""}; !reflect.DeepEqual(md.DS.Tags, want) {
+			t.Errorf("%s: expected tags %v, got %v", tt.name, want, md.DS.Tags)
+		}
+	}
+}
+
+func TestLXDAdapterInvalidMetaData(t *testing.T) {
+	md := decodeInstanceData(map[string]interface{}{
+		"v1": testV1("lxd", "lxd"),
+		"ds": map[string]interface{}{"meta-data": "instance-id: [unterminated"},
+	})
+	if err := md.check("ds.meta_data.instance_type"); err == nil {
+		t.Error("expected error for invalid LXD meta-data")
+	}
+	if err := md.check("v1.instance_id"); err != nil {
+		t.Errorf("unexpected error for v1: %v", err)
+	}
+}
+
+func TestDSAdaptersDoNotModifySnapshot(t *testing.T) {
+	meta := map[string]interface{}{"hostname": "os-vm", "meta": map[string]interface{}{"a": "b"}}
+	decodeInstanceData(map[string]interface{}{
+		"v1": testV1("openstack", "openstack"),
+		"ds": map[string]interface{}{"meta_data": meta},
+	})
+	if len(meta) != 2 {
+		t.Errorf("adapter modified the instance data: %v", meta)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// auditEntry is one line of the credential audit log.  It identifies the
+// credentials handed out by access key ID only and never carries the
+// secret key or session token.
+type auditEntry struct {
+	Time        string `json:"time"`
+	Endpoint    string `json:"endpoint"`
+	Client      string `json:"client"`
+	UID         *int   `json:"uid,omitempty"`
+	PID         int    `json:"pid,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	TokenID     string `json:"token_id,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	Role        string `json:"role,omitempty"`
+	RoleArn     string `json:"role_arn,omitempty"`
+	AccessKeyID string `json:"access_key_id,omitempty"`
+	Status      int    `json:"status"`
+}
+
+// auditLog is an append-only JSON-lines log rotated by size, keeping
+// maxBackups old files as <path>.1 (newest) to <path>.<maxBackups>.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openAuditLog(path string, maxSize int64, maxBackups int) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, st.Size()
+	return nil
+}
+
+func (l *auditLog) write(e *auditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if l.maxBackups > 0 {
+		for i := l.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", l.path, i),
+				fmt.Sprintf("%s.%d", l.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// tokenID returns a stable identifier for a session or authorization
+// token that does not reveal the token itself.
+func tokenID(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditRecord collects what a credential handler knows about a request
+// for the audit log.  Its methods may be called on a nil record, which is
+// what auditRecordFrom returns when auditing is disabled.
+type auditRecord struct {
+	skipped     bool
+	subject     string
+	role        *servedRole
+	accessKeyID string
+}
+
+type auditContextKey struct{}
+
+func auditRecordFrom(r *http.Request) *auditRecord {
+	rec, _ := r.Context().Value(auditContextKey{}).(*auditRecord)
+	return rec
+}
+
+// skip excludes the request from the audit log, e.g. role listings
+// served by a credentials handler.
+func (a *auditRecord) skip() {
+	if a != nil {
+		a.skipped = true
+	}
+}
+
+// setSubject records a caller identity beyond the client address, such
+// as a service account.
+func (a *auditRecord) setSubject(subject string) {
+	if a != nil {
+		a.subject = subject
+	}
+}
+
+func (a *auditRecord) setRole(role *servedRole) {
+	if a != nil {
+		a.role = role
+	}
+}
+
+// setAccessKeyID records the access key handed out to the client.
+func (a *auditRecord) setAccessKeyID(accessKeyID string) {
+	if a != nil {
+		a.accessKeyID = accessKeyID
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditCredentials wraps a credential handler so that every request it
+// serves is recorded in the audit log, if one is configured.  tokenHeader
+// names the header carrying the client's token.
+func (s *Server) auditCredentials(tokenHeader string, handler http.Handler) http.Handler {
+	if s.audit == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &auditRecord{}
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec))
+		handler.ServeHTTP(rw, r)
+		if !rec.skipped {
+			s.writeAuditEntry(r, rw.status, r.Header.Get(tokenHeader), rec)
+		}
+	})
+}
+
+func (s *Server) writeAuditEntry(r *http.Request, status int, token string, rec *auditRecord) {
+	e := &auditEntry{
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Endpoint:    r.URL.Path,
+		Client:      r.RemoteAddr,
+		TokenID:     tokenID(token),
+		Subject:     rec.subject,
+		AccessKeyID: rec.accessKeyID,
+		Status:      status,
+	}
+	if rec.role != nil {
+		e.Role, e.RoleArn = rec.role.name, rec.role.arn
+	}
+	if s.peers != nil {
+		localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if localAddr != nil {
+			peer, err := s.peers.ResolvePeer(r.RemoteAddr, localAddr.String(), true)
+			if err == nil {
+				uid := peer.UID
+				e.UID, e.PID, e.Unit = &uid, peer.PID, peer.Unit
+			}
+		}
+	}
+
+	if err := s.audit.write(e); err != nil {
+		klog.Errorf("could not write audit log: %v", err)
+	}
+}
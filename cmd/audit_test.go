@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newAuditTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServerWithIAM(t, baseTestData())
+	s.audit = audit
+	return s, path
+}
+
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("bad audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditIMDSCredentials(t *testing.T) {
+	s, path := newAuditTestServer(t)
+	s.peers = &mockPeerResolver{peers: map[string]*peerInfo{
+		"127.0.0.1:40000": {UID: 1000, PID: 4242, Unit: "app.service"},
+	}}
+	h := s.Handler()
+
+	for _, p := range []string{"", "test-role", "wrong-role"} {
+		req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/"+p, nil)
+		req.RemoteAddr = "127.0.0.1:40000"
+		req.Header.Set(imdsTokenHeader, "session-token")
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey,
+			&net.TCPAddr{IP: net.IPv4(169, 254, 169, 254), Port: 80}))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries (listing is not audited), got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.Endpoint != "/latest/meta-data/iam/security-credentials/test-role" ||
+		e.Status != http.StatusOK || e.Role != "test-role" ||
+		e.AccessKeyID != "AKIATEST" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.TokenID == "" || e.TokenID != tokenID("session-token") {
+		t.Errorf("unexpected token ID %q", e.TokenID)
+	}
+	if e.UID == nil || *e.UID != 1000 || e.PID != 4242 || e.Unit != "app.service" {
+		t.Errorf("unexpected peer in entry %+v", e)
+	}
+
+	if e := entries[1]; e.Status != http.StatusNotFound || e.AccessKeyID != "" {
+		t.Errorf("unexpected entry for unknown role %+v", e)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "tok\"", "session-token"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("audit log contains %q:\n%s", secret, data)
+		}
+	}
+}
+
+func TestAuditContainerCredentials(t *testing.T) {
+	s, path := newAuditTestServer(t)
+	h := s.ContainerHandler("secret-token")
+
+	for _, token := range []string{"wrong", "secret-token"} {
+		req := httptest.NewRequest("GET", containerCredentialsPath, nil)
+		req.Header.Set("Authorization", token)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Status != http.StatusUnauthorized || e.Role != "" {
+		t.Errorf("unexpected entry for rejected token %+v", e)
+	}
+	if e := entries[1]; e.Status != http.StatusOK || e.AccessKeyID != "AKIATEST" ||
+		e.TokenID != tokenID("secret-token") {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/test-role", nil)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 without audit log, got %d", w.Code)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.write(&auditEntry{Endpoint: "/v2/credentials", Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		if st.Size() > 200 {
+			t.Errorf("%s exceeds max size: %d", name, st.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+const (
+	stsEndpointsRegional = "regional"
+	stsEndpointsLegacy   = "legacy"
+)
+
+// newAWSHTTPClient returns the HTTP client used for AWS API calls made by
+// the credential subsystem, honoring -aws-https-proxy and -aws-ca-bundle,
+// or nil if neither is set and the SDK default applies.
+func newAWSHTTPClient(opts *Options) (*http.Client, error) {
+	if opts.AWSHTTPSProxy == "" && opts.AWSCABundle == "" {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.AWSHTTPSProxy != "" {
+		proxy, err := url.Parse(opts.AWSHTTPSProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -aws-https-proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if opts.AWSCABundle != "" {
+		pem, err := os.ReadFile(opts.AWSCABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.AWSCABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// applyEndpointOptions sets the FIPS, dual-stack and STS regional endpoint
+// selection and the HTTP client of config from the options.  Endpoints
+// overridden in services.endpoints are used as is.
+func (s *Server) applyEndpointOptions(config *aws.Config) (*aws.Config, error) {
+	if s.options.AWSUseFIPSEndpoint {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if s.options.AWSUseDualStackEndpoint {
+		config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	switch s.options.AWSSTSRegionalEndpoints {
+	case "":
+	case stsEndpointsRegional:
+		config.STSRegionalEndpoint = endpoints.RegionalSTSEndpoint
+	case stsEndpointsLegacy:
+		config.STSRegionalEndpoint = endpoints.LegacySTSEndpoint
+	default:
+		return nil, fmt.Errorf(
+			"unknown STS endpoint selection: %q", s.options.AWSSTSRegionalEndpoints)
+	}
+	if s.awsHTTPClient != nil {
+		config.HTTPClient = s.awsHTTPClient
+	}
+	return config, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestSTSEndpointSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		endpoint string
+	}{
+		{"default", Options{}, "https://sts.amazonaws.com"},
+		{"regional", Options{AWSSTSRegionalEndpoints: "regional"}, "https://sts.us-west-2.amazonaws.com"},
+		{"fips", Options{AWSUseFIPSEndpoint: true}, "https://sts-fips.us-west-2.amazonaws.com"},
+		{"dualstack", Options{AWSUseDualStackEndpoint: true}, "https://sts.us-west-2.api.aws"},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, baseTestData())
+		opts := tt.opts
+		s.options = &opts
+		config, err := s.getAWSConfig(credentials.AnonymousCredentials)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		sess, err := session.NewSession(config)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := sts.New(sess).Endpoint; got != tt.endpoint {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.endpoint, got)
+		}
+	}
+
+	s := newTestServer(t, baseTestData())
+	s.options.AWSSTSRegionalEndpoints = "nearest"
+	if _, err := s.applyEndpointOptions(aws.NewConfig()); err == nil {
+		t.Error("expected error for unknown STS endpoint selection")
+	}
+}
+
+func TestAWSHTTPClientCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	if client, err := newAWSHTTPClient(&Options{}); err != nil || client != nil {
+		t.Fatalf("expected SDK default client, got %v (%v)", client, err)
+	}
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newAWSHTTPClient(&Options{AWSCABundle: bundle})
+	if err != nil {
+		t.Fatalf("newAWSHTTPClient: %v", err)
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request with CA bundle failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestAWSHTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	client, err := newAWSHTTPClient(&Options{AWSHTTPSProxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("newAWSHTTPClient: %v", err)
+	}
+	resp, err := client.Get("http://sts.example.invalid/")
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != "http://sts.example.invalid/" {
+		t.Errorf("expected request through proxy, got %q", proxied)
+	}
+}
+
+func TestGetAWSConfigInvalidInstanceData(t *testing.T) {
+	data := baseTestData()
+	v1 := data["v1"].(map[string]interface{})
+	delete(v1, "region")
+	delete(v1, "availability_zone")
+	s := newTestServerWithIAM(t, data)
+	if _, err := s.getAWSConfig(credentials.AnonymousCredentials); err == nil {
+		t.Error("expected error without a region")
+	}
+
+	// Per-caller roles fail the request rather than the server.
+	if _, err := s.roleCache.get("arn:aws:iam::123456789012:role/web"); err == nil {
+		t.Error("expected error assuming a role without a region")
+	}
+}
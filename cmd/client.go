@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	credentialFormatProcess = "process"
+	credentialFormatEnv     = "env"
+	credentialFormatINI     = "ini"
+
+	clientTokenTTL = "21600"
+)
+
+// imdsClient fetches role credentials from a running server over IMDSv2.
+type imdsClient struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newIMDSClient returns a client for the server at endpoint, or, if socket
+// is set, for the server listening on that unix socket.
+func newIMDSClient(endpoint, socket string) *imdsClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	if socket != "" {
+		endpoint = "http://localhost"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &imdsClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}
+}
+
+func (c *imdsClient) do(method, path, token string) (string, error) {
+	req, err := http.NewRequest(method, c.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if method == http.MethodPut {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", clientTokenTTL)
+	} else {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: status %d: %s", method, path,
+			resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// getCredentials returns the credentials of role, or of the role the
+// server lists for this client if role is empty.
+func (c *imdsClient) getCredentials(role string) (*IMDSCredentials, error) {
+	token, err := c.do(http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return nil, err
+	}
+	const prefix = "/latest/meta-data/iam/security-credentials/"
+	if role == "" {
+		list, err := c.do(http.MethodGet, prefix, token)
+		if err != nil {
+			return nil, err
+		}
+		role = strings.TrimSpace(strings.SplitN(list, "\n", 2)[0])
+		if role == "" {
+			return nil, errors.New("no role is available")
+		}
+	}
+	body, err := c.do(http.MethodGet, prefix+role, token)
+	if err != nil {
+		return nil, err
+	}
+	var creds IMDSCredentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return nil, fmt.Errorf("cannot parse credentials: %w", err)
+	}
+	return &creds, nil
+}
+
+// processCredentials is the credential_process output format.
+type processCredentials struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken,omitempty"`
+	Expiration      string `json:"Expiration,omitempty"`
+}
+
+// formatCredentials renders creds in one of the credential formats.
+// profile names the section of the ini format.
+func formatCredentials(format, profile string, creds *IMDSCredentials) (string, error) {
+	switch format {
+	case credentialFormatProcess:
+		data, err := json.MarshalIndent(processCredentials{
+			Version:         1,
+			AccessKeyID:     creds.AccessKeyID,
+			SecretAccessKey: creds.SecretAccessKey,
+			SessionToken:    creds.Token,
+			Expiration:      creds.Expiration,
+		}, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	case credentialFormatEnv:
+		var b strings.Builder
+		for _, kv := range [][2]string{
+			{"AWS_ACCESS_KEY_ID", creds.AccessKeyID},
+			{"AWS_SECRET_ACCESS_KEY", creds.SecretAccessKey},
+			{"AWS_SESSION_TOKEN", creds.Token},
+			{"AWS_CREDENTIAL_EXPIRATION", creds.Expiration},
+		} {
+			if kv[1] != "" {
+				fmt.Fprintf(&b, "export %s=%s\n", kv[0], shellQuote(kv[1]))
+			}
+		}
+		return b.String(), nil
+	case credentialFormatINI:
+		var b strings.Builder
+		fmt.Fprintf(&b, "[%s]\n", profile)
+		for _, line := range iniCredentialLines(creds) {
+			fmt.Fprintf(&b, "%s\n", line)
+		}
+		return b.String(), nil
+	default:
+		return "", fmt.Errorf("unknown credential format: %q", format)
+	}
+}
+
+// iniCredentialLines returns the shared credentials file entries for creds.
+func iniCredentialLines(creds *IMDSCredentials) []string {
+	lines := []string{
+		"aws_access_key_id = " + creds.AccessKeyID,
+		"aws_secret_access_key = " + creds.SecretAccessKey,
+	}
+	if creds.Token != "" {
+		lines = append(lines, "aws_session_token = "+creds.Token)
+	}
+	return lines
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runCredentialsCommand implements the export-credentials and
+// credential-process subcommands, which print the credentials served by a
+// running server in defaultFormat unless -format is given.
+func runCredentialsCommand(name string, args []string, defaultFormat string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		endpoint = fs.String("endpoint", "http://169.254.169.254", "URL of the running server.")
+		socket   = fs.String("socket", "", "Unix socket of the running server, used instead of -endpoint.")
+		format   = fs.String("format", defaultFormat, "Output format (process, env, ini).")
+		role     = fs.String("role", "", "Role to fetch (defaults to the role listed for this client).")
+		profile  = fs.String("profile", "default", "Profile name used by the ini format.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	creds, err := newIMDSClient(*endpoint, *socket).getCredentials(*role)
+	if err == nil {
+		var out string
+		out, err = formatCredentials(*format, *profile, creds)
+		if err == nil {
+			_, err = io.WriteString(stdout, out)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// listenUnix listens on a unix socket at path, replacing a stale socket,
+// and sets its permissions to mode and, unless gid is -1, its group to
+// gid.
+func listenUnix(path string, mode os.FileMode, gid int) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
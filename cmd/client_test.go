@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsCommandFormats(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := runCredentialsCommand("credential-process",
+		[]string{"-endpoint", srv.URL}, credentialFormatProcess, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	var proc processCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &proc); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	want := processCredentials{
+		Version:         1,
+		AccessKeyID:     "AKIATEST",
+		SecretAccessKey: "secret",
+		SessionToken:    "tok",
+		Expiration:      "2099-01-01T00:00:00Z",
+	}
+	if proc != want {
+		t.Errorf("expected %+v, got %+v", want, proc)
+	}
+
+	stdout.Reset()
+	code = runCredentialsCommand("export-credentials",
+		[]string{"-endpoint", srv.URL}, credentialFormatEnv, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	wantEnv := "export AWS_ACCESS_KEY_ID='AKIATEST'\n" +
+		"export AWS_SECRET_ACCESS_KEY='secret'\n" +
+		"export AWS_SESSION_TOKEN='tok'\n" +
+		"export AWS_CREDENTIAL_EXPIRATION='2099-01-01T00:00:00Z'\n"
+	if stdout.String() != wantEnv {
+		t.Errorf("unexpected env output:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	code = runCredentialsCommand("export-credentials",
+		[]string{"-endpoint", srv.URL, "-format", "ini", "-profile", "vm"},
+		credentialFormatEnv, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	wantINI := "[vm]\naws_access_key_id = AKIATEST\n" +
+		"aws_secret_access_key = secret\naws_session_token = tok\n"
+	if stdout.String() != wantINI {
+		t.Errorf("unexpected ini output:\n%s", stdout.String())
+	}
+}
+
+func TestCredentialsCommandErrors(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := runCredentialsCommand("credential-process",
+		[]string{"-endpoint", srv.URL, "-role", "other-role"},
+		credentialFormatProcess, &stdout, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "404") {
+		t.Errorf("expected failure for unknown role, got %d: %s", code, stderr.String())
+	}
+
+	stderr.Reset()
+	code = runCredentialsCommand("credential-process",
+		[]string{"-endpoint", srv.URL, "-format", "yaml"},
+		credentialFormatProcess, &stdout, &stderr)
+	if code != 1 || !strings.Contains(stderr.String(), "unknown credential format") {
+		t.Errorf("expected failure for unknown format, got %d: %s", code, stderr.String())
+	}
+}
+
+func TestCredentialsCommandUnixSocket(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	path := filepath.Join(t.TempDir(), "imds.sock")
+	l, err := listenUnix(path, 0o600, -1)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	srv := &http.Server{Handler: s.Handler()}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := runCredentialsCommand("credential-process",
+		[]string{"-socket", path}, credentialFormatProcess, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"AccessKeyId": "AKIATEST"`) {
+		t.Errorf("unexpected output %s", stdout.String())
+	}
+}
+
+func TestListenUnixPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imds.sock")
+	gid := os.Getgid()
+	l, err := listenUnix(path, 0o660, gid)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	defer l.Close()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0o660 {
+		t.Errorf("expected mode 0660, got %o", st.Mode().Perm())
+	}
+	if _, sockGID := fileOwner(st); sockGID != gid {
+		t.Errorf("expected group %d, got %d", gid, sockGID)
+	}
+	if _, err := lookupGroup(strconv.Itoa(gid)); err != nil {
+		t.Errorf("lookupGroup: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// credentialFileSync is a shared credentials file kept up to date with the
+// served role credentials.
+type credentialFileSync struct {
+	Path    string
+	Profile string
+	// UID and GID are -1 to keep the owner of an existing file, or else
+	// of the server process, and Mode 0 to keep the mode of an existing
+	// file, or else to use 0600.
+	UID  int
+	GID  int
+	Mode os.FileMode
+}
+
+// credentialFileSyncs is a flag.Value collecting -sync-credentials-file
+// flags of the form path[,profile=name][,owner=user[:group]][,mode=0600].
+type credentialFileSyncs []credentialFileSync
+
+func (c *credentialFileSyncs) String() string {
+	if c == nil {
+		return ""
+	}
+	paths := make([]string, len(*c))
+	for i, s := range *c {
+		paths[i] = s.Path
+	}
+	return strings.Join(paths, " ")
+}
+
+func (c *credentialFileSyncs) Set(value string) error {
+	parts := strings.Split(value, ",")
+	entry := credentialFileSync{
+		Path:    parts[0],
+		Profile: "default",
+		UID:     -1,
+		GID:     -1,
+	}
+	if entry.Path == "" {
+		return fmt.Errorf("missing path in %q", value)
+	}
+	for _, opt := range parts[1:] {
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "profile":
+			entry.Profile = val
+		case "owner":
+			uid, gid, err := lookupOwner(val)
+			if err != nil {
+				return err
+			}
+			entry.UID, entry.GID = uid, gid
+		case "mode":
+			mode, err := strconv.ParseUint(val, 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid mode %q: %w", val, err)
+			}
+			entry.Mode = os.FileMode(mode)
+		default:
+			return fmt.Errorf("unknown credentials file option %q", key)
+		}
+	}
+	*c = append(*c, entry)
+	return nil
+}
+
+// lookupOwner resolves user[:group], by name or number, to a UID and GID.
+// Without a group, the user's primary group is used.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	if hasGroup {
+		gid, err := lookupGroup(groupName)
+		return uid, gid, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup resolves a group, by name or number, to a GID.
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if g, err = user.LookupGroupId(name); err != nil {
+			return 0, err
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// syncCredentialFiles writes creds to every configured credentials file.
+// Failures are logged and do not affect the served credentials.
+func (s *Server) syncCredentialFiles(creds *IMDSCredentials) {
+	for _, f := range s.options.CredentialFileSyncs {
+		if err := f.write(creds); err != nil {
+			klog.Errorf("could not update credentials file %s: %v", f.Path, err)
+		} else {
+			klog.V(2).Infof("updated profile %s in %s", f.Profile, f.Path)
+		}
+	}
+}
+
+// write replaces the credentials of the profile in the file, leaving other
+// profiles and other settings of the profile untouched.  The file is
+// rewritten atomically while holding an exclusive lock on <path>.lock.
+//
+// The server usually runs as root and writes into directories owned by
+// the users it writes for, so nothing there is trusted: symlinks are not
+// followed, and the directory must belong to root, the server or the
+// configured owner.  Directories it creates, and the lock, are given to
+// the configured owner.
+func (f *credentialFileSync) write(creds *IMDSCredentials) error {
+	dir := filepath.Dir(f.Path)
+	if err := mkdirOwned(dir, f.UID, f.GID); err != nil {
+		return err
+	}
+	if err := f.checkDir(dir); err != nil {
+		return err
+	}
+	unlock, err := lockFile(f.Path+".lock", f.UID, f.GID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mode, uid, gid := f.Mode, f.UID, f.GID
+	var old []byte
+	if info, err := os.Lstat(f.Path); err == nil {
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", f.Path)
+		}
+		if mode == 0 {
+			mode = info.Mode().Perm()
+		}
+		if uid < 0 && gid < 0 {
+			uid, gid = fileOwner(info)
+		}
+		if old, err = readFileNoFollow(f.Path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if mode == 0 {
+		mode = 0o600
+	}
+	content := updateINISection(string(old), f.Profile, iniCredentialLines(creds))
+
+	// CreateTemp creates the file exclusively, so it does not follow a
+	// symlink planted at its name.
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := tmp.Chown(uid, gid); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// checkDir refuses to write into dir if it is a symlink, or is owned by
+// anyone other than root, the server or the configured owner.
+func (f *credentialFileSync) checkDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	uid, _ := fileOwner(info)
+	if uid > 0 && uid != os.Geteuid() && uid != f.UID {
+		return fmt.Errorf("%s is owned by UID %d, not by the credentials file owner", dir, uid)
+	}
+	return nil
+}
+
+// mkdirOwned creates dir and any missing parents with mode 0700, giving
+// those it creates to uid and gid unless they are -1.
+func mkdirOwned(dir string, uid, gid int) error {
+	if _, err := os.Lstat(dir); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := mkdirOwned(filepath.Dir(dir), uid, gid); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+	if uid >= 0 || gid >= 0 {
+		return os.Lchown(dir, uid, gid)
+	}
+	return nil
+}
+
+// readFileNoFollow reads path, failing if it is a symlink.
+func readFileNoFollow(path string) ([]byte, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// credentialKeys are the keys replaced by updateINISection.
+var credentialKeys = map[string]bool{
+	"aws_access_key_id":     true,
+	"aws_secret_access_key": true,
+	"aws_session_token":     true,
+	"aws_security_token":    true,
+}
+
+// updateINISection returns content with the credential keys of section
+// replaced by lines, appending the section if it does not exist.
+func updateINISection(content, section string, lines []string) string {
+	var src, out []string
+	if content != "" {
+		src = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+
+	found := false
+	for i := 0; i < len(src); i++ {
+		out = append(out, src[i])
+		name, ok := iniSectionName(src[i])
+		if !ok || name != section {
+			continue
+		}
+
+		j := i + 1
+		for j < len(src) {
+			if _, ok := iniSectionName(src[j]); ok {
+				break
+			}
+			j++
+		}
+		body := src[i+1 : j]
+		end := len(body)
+		for end > 0 && strings.TrimSpace(body[end-1]) == "" {
+			end--
+		}
+		for _, line := range body[:end] {
+			key, _, _ := strings.Cut(line, "=")
+			if !credentialKeys[strings.TrimSpace(key)] {
+				out = append(out, line)
+			}
+		}
+		// Credentials go into the first occurrence of the section
+		// only, and are removed from any later ones.
+		if !found {
+			out = append(out, lines...)
+			found = true
+		}
+		out = append(out, body[end:]...)
+		i = j - 1
+	}
+
+	if !found {
+		if len(out) != 0 && strings.TrimSpace(out[len(out)-1]) != "" {
+			out = append(out, "")
+		}
+		out = append(out, "["+section+"]")
+		out = append(out, lines...)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// iniSectionName returns the name of the section started by line, if it
+// is a section header.
+func iniSectionName(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+		return "", false
+	}
+	return strings.Join(strings.Fields(line[1:len(line)-1]), " "), true
+}
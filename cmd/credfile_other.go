@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// oNoFollow is 0, as there is no O_NOFOLLOW here.
+const oNoFollow = 0
+
+// lockFile is only implemented with flock; elsewhere concurrent writers
+// are not excluded, though each write still replaces the file atomically.
+func lockFile(path string, uid, gid int) (func(), error) {
+	return func() {}, nil
+}
+
+// fileOwner returns -1 for both IDs, as files have no UID and GID here.
+func fileOwner(info os.FileInfo) (int, int) {
+	return -1, -1
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestUpdateINISection(t *testing.T) {
+	lines := []string{"aws_access_key_id = NEW", "aws_secret_access_key = newsecret"}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "empty file",
+			content: "",
+			want:    "[vm]\naws_access_key_id = NEW\naws_secret_access_key = newsecret\n",
+		},
+		{
+			name:    "other profiles kept",
+			content: "[default]\naws_access_key_id = DEF\n",
+			want: "[default]\naws_access_key_id = DEF\n\n" +
+				"[vm]\naws_access_key_id = NEW\naws_secret_access_key = newsecret\n",
+		},
+		{
+			name: "existing profile replaced",
+			content: "[vm]\nregion = us-west-2\naws_access_key_id = OLD\n" +
+				"aws_session_token = oldtoken\n\n[other]\naws_access_key_id = OTHER\n",
+			want: "[vm]\nregion = us-west-2\naws_access_key_id = NEW\n" +
+				"aws_secret_access_key = newsecret\n\n[other]\naws_access_key_id = OTHER\n",
+		},
+		{
+			name:    "duplicate section",
+			content: "[vm]\naws_access_key_id = OLD\n[vm]\naws_secret_access_key = old\n",
+			want: "[vm]\naws_access_key_id = NEW\naws_secret_access_key = newsecret\n" +
+				"[vm]\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := updateINISection(tt.content, "vm", lines); got != tt.want {
+			t.Errorf("%s: expected\n%q\ngot\n%q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestCredentialFileSyncsFlag(t *testing.T) {
+	var syncs credentialFileSyncs
+	if err := syncs.Set("/tmp/creds,profile=vm,mode=0640"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := syncs.Set("/tmp/other"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	want := credentialFileSyncs{
+		{Path: "/tmp/creds", Profile: "vm", UID: -1, GID: -1, Mode: 0o640},
+		{Path: "/tmp/other", Profile: "default", UID: -1, GID: -1},
+	}
+	if len(syncs) != len(want) || syncs[0] != want[0] || syncs[1] != want[1] {
+		t.Errorf("expected %+v, got %+v", want, syncs)
+	}
+
+	for _, bad := range []string{"", "/tmp/x,mode=rw", "/tmp/x,color=red"} {
+		if err := syncs.Set(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSyncCredentialFilesOnPublish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".aws", "credentials")
+	s := newTestServerWithIAM(t, baseTestData())
+	s.options.CredentialFileSyncs = credentialFileSyncs{
+		{Path: path, Profile: "default", UID: -1, GID: -1, Mode: 0o640},
+	}
+
+	creds := credentials.NewStaticCredentials("AKIAFIRST", "first", "")
+	if err := s.publishCredentials(creds); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("[default]\naws_access_key_id = AKIAFIRST\n\n[legacy]\nregion = eu-west-1\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	creds = credentials.NewStaticCredentials("AKIASECOND", "second", "token2")
+	if err := s.publishCredentials(creds); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[default]\naws_access_key_id = AKIASECOND\naws_secret_access_key = second\n" +
+		"aws_session_token = token2\n\n[legacy]\nregion = eu-west-1\n"
+	if string(data) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, data)
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0o640 {
+		t.Errorf("expected mode 0640, got %o", st.Mode().Perm())
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only the file and its lock, got %v", entries)
+	}
+}
+
+func TestCredentialFileSyncKeepsExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(path, []byte("[other]\nregion = eu-west-1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &credentialFileSync{Path: path, Profile: "default", UID: -1, GID: -1}
+	if err := f.write(&IMDSCredentials{AccessKeyID: "AKIAKEEP", SecretAccessKey: "keep"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0o644 {
+		t.Errorf("expected mode 0644 to be kept, got %o", st.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "AKIAKEEP") {
+		t.Errorf("expected the file to be updated, got %q (%v)", data, err)
+	}
+}
+
+func TestCredentialFileSyncRefusesSymlink(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "shadow")
+	if err := os.WriteFile(outside, []byte("root:x:0:0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), ".aws")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "credentials")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &credentialFileSync{Path: link, Profile: "default", UID: -1, GID: -1}
+	if err := f.write(&IMDSCredentials{AccessKeyID: "AKIAEVIL", SecretAccessKey: "evil"}); err == nil {
+		t.Error("expected a symlink to be refused")
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "root:x:0:0\n" {
+		t.Errorf("expected the symlink target to be left alone, got %q", data)
+	}
+	if st, err := os.Lstat(link); err != nil || st.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the symlink to be left alone, got %v (%v)", st, err)
+	}
+
+	// A symlinked directory is refused too.
+	linkedDir := filepath.Join(t.TempDir(), "aws")
+	if err := os.Symlink(filepath.Dir(outside), linkedDir); err != nil {
+		t.Fatal(err)
+	}
+	f.Path = filepath.Join(linkedDir, "shadow")
+	if err := f.write(&IMDSCredentials{AccessKeyID: "AKIAEVIL", SecretAccessKey: "evil"}); err == nil {
+		t.Error("expected a symlinked directory to be refused")
+	}
+}
+
+func TestCredentialFileSyncCreatesOwnedDirectory(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	path := filepath.Join(t.TempDir(), "home", ".aws", "credentials")
+	f := &credentialFileSync{Path: path, Profile: "default", UID: 1234, GID: 5678}
+	if err := f.write(&IMDSCredentials{AccessKeyID: "AKIAOWN", SecretAccessKey: "own"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	for _, p := range []string{filepath.Dir(filepath.Dir(path)), filepath.Dir(path), path, path + ".lock"} {
+		st, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid := fileOwner(st); uid != 1234 || gid != 5678 {
+			t.Errorf("%s: expected owner 1234:5678, got %d:%d", p, uid, gid)
+		}
+	}
+}
+
+func TestCredentialFileSyncRefusesForeignDirectory(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	dir := filepath.Join(t.TempDir(), ".aws")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(dir, 4321, 4321); err != nil {
+		t.Fatal(err)
+	}
+	f := &credentialFileSync{Path: filepath.Join(dir, "credentials"), Profile: "default", UID: 1234, GID: 1234}
+	if err := f.write(&IMDSCredentials{AccessKeyID: "AKIAX", SecretAccessKey: "x"}); err == nil {
+		t.Error("expected a directory of another user to be refused")
+	}
+}
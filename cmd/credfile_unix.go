@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// oNoFollow makes opening a symlink fail.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// lockFile takes an exclusive flock on path, creating it if needed, owned
+// by uid and gid unless they are -1, and returns a function releasing it.
+// A symlink at path is not followed.
+func lockFile(path string, uid, gid int) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := f.Chown(uid, gid); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// fileOwner returns the UID and GID owning the file described by info.
+func fileOwner(info os.FileInfo) (int, int) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(st.Uid), int(st.Gid)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// dmiInstanceData derives instance data from the SMBIOS tables the
+// hypervisor exposes through sysfs, so that the emulator can answer when
+// cloud-init has not run or left fields out.  It reads:
+//
+//   - OEM strings (SMBIOS type 11) of the form imds.<key>=<value>, which
+//     set any field through imdsSettingsData, e.g. imds.az=lab-1a or
+//     imds.tag.Team=infra (QEMU: -smbios type=11,value=imds.az=lab-1a);
+//   - the system serial number, if it holds a NoCloud seed of the form
+//     ds=nocloud;i=<instance-id>;h=<hostname>;
+//   - the baseboard asset tag, which holds the instance ID on EC2 Nitro
+//     instances, and the system UUID otherwise, as the instance ID;
+//   - the product name, which holds the instance type on EC2 Nitro
+//     instances;
+//   - the chassis and baseboard asset tags, unless they are vendor
+//     filler, as the ChassisAssetTag and BoardAssetTag tags.
+//
+// OEM strings take precedence over the other hints.  Most of these files
+// are only readable by root; the ones that cannot be read are skipped.
+// The tables do not change while the system runs, so they are read once.
+type dmiInstanceData struct {
+	root string
+
+	snap *instanceDataSnapshot
+	err  error
+}
+
+// newDMIInstanceData reads the SMBIOS data under the sysfs mounted at
+// root.
+func newDMIInstanceData(root string) *dmiInstanceData {
+	d := &dmiInstanceData{root: root}
+	data, err := d.load()
+	if err != nil {
+		klog.Warningf("SMBIOS instance data is not available: %v", err)
+		d.err = err
+	} else {
+		d.snap = newInstanceDataSnapshot(data)
+	}
+	return d
+}
+
+func (d *dmiInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	return d.snap, d.err
+}
+
+// dmiFiller are asset tag values firmware uses for unset fields, or that
+// are the same for every instance of a cloud.
+var dmiFiller = map[string]bool{
+	"":                       true,
+	"none":                   true,
+	"default string":         true,
+	"not specified":          true,
+	"to be filled by o.e.m.": true,
+	"no asset tag":           true,
+	"amazon ec2":             true,
+}
+
+// ec2InstanceType matches instance type names such as m5.large.
+var ec2InstanceType = regexp.MustCompile(`^[a-z][a-z0-9-]*\.[a-z0-9]+$`)
+
+func (d *dmiInstanceData) load() (map[string]interface{}, error) {
+	id := filepath.Join(d.root, "class", "dmi", "id")
+	if _, err := os.Stat(id); err != nil {
+		return nil, err
+	}
+
+	settings := map[string]interface{}{}
+	set := func(key, value string) {
+		key = canonicalIMDSSetting(key)
+		if _, found := settings[key]; !found && value != "" {
+			settings[key] = value
+		}
+	}
+
+	oem, err := d.oemStrings()
+	if err != nil {
+		klog.V(2).Infof("not using SMBIOS OEM strings: %v", err)
+	}
+	for _, s := range oem {
+		if key, value, ok := strings.Cut(s, "="); ok && strings.HasPrefix(key, "imds.") {
+			set(strings.TrimPrefix(key, "imds."), value)
+		}
+	}
+
+	serial := d.readID("product_serial")
+	if seed, ok := strings.CutPrefix(serial, "ds=nocloud"); ok {
+		for _, field := range strings.Split(seed, ";") {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "i", "instance-id":
+				set("instance_id", value)
+			case "h", "local-hostname":
+				set("local_hostname", value)
+			}
+		}
+	}
+	boardTag := d.readID("board_asset_tag")
+	if strings.HasPrefix(boardTag, "i-") {
+		set("instance_id", boardTag)
+		boardTag = ""
+	}
+	set("instance_id", strings.ToLower(d.readID("product_uuid")))
+	if name := d.readID("product_name"); ec2InstanceType.MatchString(name) {
+		set("instance_type", name)
+	}
+	if !dmiFiller[strings.ToLower(boardTag)] {
+		set("tag.BoardAssetTag", boardTag)
+	}
+	if chassisTag := d.readID("chassis_asset_tag"); !dmiFiller[strings.ToLower(chassisTag)] {
+		set("tag.ChassisAssetTag", chassisTag)
+	}
+
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("no usable SMBIOS data in %s", id)
+	}
+	return imdsSettingsData(settings), nil
+}
+
+// readID returns the trimmed contents of a /sys/class/dmi/id file, or
+// an empty string if it cannot be read.
+func (d *dmiInstanceData) readID(name string) string {
+	data, err := os.ReadFile(filepath.Join(d.root, "class", "dmi", "id", name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			klog.V(2).Infof("not using SMBIOS %s: %v", name, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// oemStrings returns the strings of the SMBIOS type 11 (OEM Strings)
+// structures, in table order.
+func (d *dmiInstanceData) oemStrings() ([]string, error) {
+	entries, err := filepath.Glob(filepath.Join(d.root, "firmware", "dmi", "entries", "11-*", "raw"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(entries)
+
+	var result []string
+	for _, path := range entries {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		strs, err := smbiosStrings(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		result = append(result, strs...)
+	}
+	return result, nil
+}
+
+// smbiosStrings returns the strings of the SMBIOS structure in raw: the
+// NUL-terminated strings that follow its formatted area, whose length is
+// in the second byte of the header.
+func smbiosStrings(raw []byte) ([]string, error) {
+	if len(raw) < 4 || int(raw[1]) > len(raw) {
+		return nil, errors.New("truncated SMBIOS structure")
+	}
+	var result []string
+	for rest := raw[raw[1]:]; len(rest) > 0; {
+		end := bytes.IndexByte(rest, 0)
+		if end <= 0 {
+			break
+		}
+		result = append(result, string(rest[:end]))
+		rest = rest[end+1:]
+	}
+	return result, nil
+}
+
+// imdsSettingsAliases map short imds.<key> settings to the instance data
+// fields they set.
+var imdsSettingsAliases = map[string]string{
+	"instance_id":       "v1.instance_id",
+	"region":            "v1.region",
+	"az":                "v1.availability_zone",
+	"availability_zone": "v1.availability_zone",
+	"instance_type":     "ds.meta_data.instance_type",
+	"hostname":          "ds.meta_data.local_hostname",
+	"local_hostname":    "ds.meta_data.local_hostname",
+}
+
+// canonicalIMDSSetting returns the field an alias stands for, so that
+// settings of the same field can be told apart from different ones.
+func canonicalIMDSSetting(key string) string {
+	if alias, ok := imdsSettingsAliases[key]; ok {
+		return alias
+	}
+	return key
+}
+
+// imdsSettingsData turns imds.<key>=<value> settings, with the prefix
+// removed, into instance data.  A key is one of imdsSettingsAliases,
+// tag.<name> for a tag, or the dotted path of any other field, e.g.
+// v1.distro.  Values are strings in SMBIOS, but may be any JSON value.
+func imdsSettingsData(settings map[string]interface{}) map[string]interface{} {
+	type setting struct {
+		path  []string
+		value interface{}
+	}
+	sorted := make([]setting, 0, len(settings))
+	for key, value := range settings {
+		var path []string
+		if tag, ok := strings.CutPrefix(key, "tag."); ok {
+			path = []string{"ds", "meta_data", "tags", tag}
+		} else {
+			path = strings.Split(canonicalIMDSSetting(key), ".")
+		}
+		sorted = append(sorted, setting{path, value})
+	}
+	// Shorter paths first, so that a field inside an object value
+	// (ds.meta_data.tags) is added to it rather than replaced by it
+	// (ds.meta_data).
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].path, sorted[j].path
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return strings.Join(a, ".") < strings.Join(b, ".")
+	})
+
+	data := map[string]interface{}{}
+	for _, s := range sorted {
+		setDataPath(data, s.path, s.value)
+	}
+	return data
+}
+
+// setDataPath sets the field at path in data, creating the objects above
+// it.  A non-object value on the way is replaced.
+func setDataPath(data map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := data[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			data[key] = next
+		}
+		data = next
+	}
+	data[path[len(path)-1]] = value
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// oemStringsEntry returns a raw SMBIOS type 11 structure holding strs.
+func oemStringsEntry(strs ...string) string {
+	raw := []byte{11, 5, 0x2a, 0x00, byte(len(strs))}
+	for _, s := range strs {
+		raw = append(raw, s...)
+		raw = append(raw, 0)
+	}
+	return string(append(raw, 0))
+}
+
+func TestDMIInstanceData(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "class/dmi/id/product_uuid", "EC2A1B2C-0000-1111-2222-333344445555\n")
+	writeTestFile(t, root, "class/dmi/id/product_serial", "ds=nocloud;h=lab-vm;s=http://10.0.0.1/\n")
+	writeTestFile(t, root, "class/dmi/id/product_name", "Standard PC (Q35 + ICH9, 2009)\n")
+	writeTestFile(t, root, "class/dmi/id/board_asset_tag", "\n")
+	writeTestFile(t, root, "class/dmi/id/chassis_asset_tag", "RACK-42\n")
+	writeTestFile(t, root, "firmware/dmi/entries/11-0/raw", oemStringsEntry(
+		"io.systemd.credential:foo=bar",
+		"imds.az=lab-1a",
+		"imds.instance_type=m5.large",
+		"imds.tag.Team=infra",
+		"imds.v1.distro=debian",
+	))
+
+	snap, err := newDMIInstanceData(root).GetInstanceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"v1": map[string]interface{}{
+			"instance_id":       "ec2a1b2c-0000-1111-2222-333344445555",
+			"availability_zone": "lab-1a",
+			"distro":            "debian",
+		},
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"local_hostname": "lab-vm",
+			"instance_type":  "m5.large",
+			"tags": map[string]interface{}{
+				"Team":            "infra",
+				"ChassisAssetTag": "RACK-42",
+			},
+		}},
+	}
+	if !reflect.DeepEqual(snap.data, want) {
+		t.Errorf("expected %v, got %v", want, snap.data)
+	}
+}
+
+func TestDMIInstanceDataNitro(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "class/dmi/id/product_uuid", "ec2e1916-9099-7caf-fd21-012345678901\n")
+	writeTestFile(t, root, "class/dmi/id/product_name", "m7g.large\n")
+	writeTestFile(t, root, "class/dmi/id/board_asset_tag", "i-0123456789abcdef0\n")
+	writeTestFile(t, root, "class/dmi/id/chassis_asset_tag", "Amazon EC2\n")
+
+	md := decodeInstanceData(newDMIInstanceData(root).snap.data)
+	if md.V1.InstanceID != "i-0123456789abcdef0" || md.DS.InstanceType != "m7g.large" {
+		t.Errorf("unexpected instance data %+v", md)
+	}
+	if len(md.DS.Tags) != 0 {
+		t.Errorf("expected no tags, got %v", md.DS.Tags)
+	}
+}
+
+func TestDMIInstanceDataMissing(t *testing.T) {
+	if _, err := newDMIInstanceData(t.TempDir()).GetInstanceData(); err == nil {
+		t.Error("expected error without SMBIOS data")
+	}
+}
+
+func TestIMDSSettingsDataOverlap(t *testing.T) {
+	want := map[string]interface{}{
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"local-hostname": "vm1",
+			"tags":           map[string]interface{}{"Team": "infra", "Env": "lab"},
+		}},
+	}
+	// Settings are a map, so repeat to cover different iteration orders.
+	for i := 0; i < 20; i++ {
+		got := imdsSettingsData(map[string]interface{}{
+			"ds.meta_data":      map[string]interface{}{"local-hostname": "vm1"},
+			"ds.meta_data.tags": map[string]interface{}{"Team": "infra"},
+			"tag.Env":           "lab",
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// containerCredentialsPath is where the container credentials endpoint
+// serves credentials, e.g. AWS_CONTAINER_CREDENTIALS_FULL_URI set to
+// http://169.254.170.2/v2/credentials.
+const containerCredentialsPath = "/v2/credentials"
+
+// containerCredentials is the ECS container credentials response format.
+type containerCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+	RoleArn         string `json:"RoleArn"`
+}
+
+// containerError is the error format of the container credentials
+// endpoint.
+type containerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// readContainerAuthToken reads the authorization token clients must pass
+// to the container endpoints.
+func readContainerAuthToken(path string) (string, error) {
+	if path == "" {
+		return "", errors.New(
+			"-container-credentials-listen requires -container-authorization-token-file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("authorization token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// ContainerHandler returns an http.Handler implementing the ECS container
+// credentials protocol used by AWS_CONTAINER_CREDENTIALS_FULL_URI and
+// AWS_CONTAINER_AUTHORIZATION_TOKEN, and, if a container definitions file
+// is configured, the ECS task metadata endpoint v4.
+func (s *Server) ContainerHandler(authToken string) http.Handler {
+	mux := http.NewServeMux()
+	creds := s.auditCredentials("Authorization", requireContainerToken(authToken,
+		http.HandlerFunc(s.containerCredentialsHandler)))
+	mux.Handle(containerCredentialsPath, creds)
+	mux.Handle(containerCredentialsPath+"/", creds)
+	if path := s.options.ECSContainerDefinitionsFile; path != "" {
+		mux.Handle(taskMetadataPrefix, s.taskMetadataHandler(&taskDefinitionFile{path: path}))
+	}
+	return containerEndpoint(mux)
+}
+
+// TaskMetadataHandler returns an http.Handler serving only the ECS task
+// metadata endpoint v4, for a listener of its own.
+func (s *Server) TaskMetadataHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(taskMetadataPrefix, s.taskMetadataHandler(
+		&taskDefinitionFile{path: s.options.ECSContainerDefinitionsFile}))
+	return containerEndpoint(mux)
+}
+
+// containerEndpoint serves the GET requests of the container endpoints
+// with mux, as JSON.
+func containerEndpoint(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		klog.V(5).Infof("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeContainerError(w, http.StatusMethodNotAllowed,
+				"MethodNotAllowed", "only GET is supported")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// requireContainerToken rejects requests whose Authorization header does
+// not carry authToken.
+func requireContainerToken(authToken string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(authToken)) != 1 {
+			writeContainerError(w, http.StatusUnauthorized,
+				"AccessDenied", "missing or invalid authorization token")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) containerCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	role, err := s.resolveRole(r)
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+	if role == nil {
+		writeContainerError(w, http.StatusNotFound,
+			"NotFound", "no role is available to this client")
+		return
+	}
+	auditRecordFrom(r).setRole(role)
+
+	imdsCreds, err := s.getRoleCredentials(role)
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+	if imdsCreds == nil {
+		writeContainerError(w, http.StatusNotFound,
+			"NotFound", "no credentials are available")
+		return
+	}
+
+	data, err := json.MarshalIndent(containerCredentials{
+		AccessKeyID:     imdsCreds.AccessKeyID,
+		SecretAccessKey: imdsCreds.SecretAccessKey,
+		Token:           imdsCreds.Token,
+		Expiration:      imdsCreds.Expiration,
+		RoleArn:         role.arn,
+	}, "", "  ")
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+	auditRecordFrom(r).setAccessKeyID(imdsCreds.AccessKeyID)
+	fmt.Fprintf(w, "%s", data)
+}
+
+func writeContainerError(w http.ResponseWriter, status int, code, message string) {
+	data, _ := json.Marshal(containerError{Code: code, Message: message})
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s", data)
+}
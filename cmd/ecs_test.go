@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+)
+
+func TestContainerCredentialsAuth(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	h := s.ContainerHandler("secret-token")
+
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", containerCredentialsPath, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("token %q: expected %d, got %d", tt.token, tt.code, w.Code)
+		}
+	}
+}
+
+func TestContainerCredentialsFormat(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	s.iamRoleArn = "arn:aws:iam::123456789012:role/test-role"
+
+	req := httptest.NewRequest("GET", containerCredentialsPath, nil)
+	req.Header.Set("Authorization", "secret-token")
+	w := httptest.NewRecorder()
+	s.ContainerHandler("secret-token").ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	var creds containerCredentials
+	if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	want := containerCredentials{
+		AccessKeyID:     "AKIATEST",
+		SecretAccessKey: "secret",
+		Token:           "tok",
+		Expiration:      "2099-01-01T00:00:00Z",
+		RoleArn:         "arn:aws:iam::123456789012:role/test-role",
+	}
+	if creds != want {
+		t.Errorf("expected %+v, got %+v", want, creds)
+	}
+}
+
+func TestContainerCredentialsSDK(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	srv := httptest.NewServer(s.ContainerHandler("secret-token"))
+	defer srv.Close()
+
+	def := defaults.Get()
+	creds := endpointcreds.NewCredentialsClient(
+		*def.Config.WithRegion("us-west-2"), def.Handlers,
+		srv.URL+containerCredentialsPath,
+		func(p *endpointcreds.Provider) { p.AuthorizationToken = "secret-token" })
+	val, err := creds.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if val.AccessKeyID != "AKIATEST" || val.SessionToken != "tok" {
+		t.Errorf("unexpected credentials %+v", val)
+	}
+}
+
+func TestReadContainerAuthToken(t *testing.T) {
+	if _, err := readContainerAuthToken(""); err == nil {
+		t.Error("expected error without a token file")
+	}
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	token, err := readContainerAuthToken(path)
+	if err != nil || token != "abc" {
+		t.Errorf("expected token abc, got %q (%v)", token, err)
+	}
+}
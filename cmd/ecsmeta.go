@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// taskMetadataPrefix is the path prefix of the ECS task metadata endpoint
+// v4; ECS_CONTAINER_METADATA_URI_V4 is http://<addr>/v4/<container-id>.
+const taskMetadataPrefix = "/v4/"
+
+// taskDefinition is the format of the container definitions file describing
+// the containers running on this instance as a single ECS task.
+type taskDefinition struct {
+	Cluster    string                `json:"cluster,omitempty"`
+	TaskID     string                `json:"task_id,omitempty"`
+	Family     string                `json:"family,omitempty"`
+	Revision   string                `json:"revision,omitempty"`
+	LaunchType string                `json:"launch_type,omitempty"`
+	Containers []containerDefinition `json:"containers"`
+}
+
+// containerDefinition describes one container of the task.
+type containerDefinition struct {
+	// ID is the Docker container ID used in the metadata URI.
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	DockerName string            `json:"docker_name,omitempty"`
+	Image      string            `json:"image,omitempty"`
+	ImageID    string            `json:"image_id,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// CPU is in CPU units (1024 per vCPU), Memory in MiB.
+	CPU         int      `json:"cpu,omitempty"`
+	Memory      int      `json:"memory,omitempty"`
+	NetworkMode string   `json:"network_mode,omitempty"`
+	IPv4        []string `json:"ipv4_addresses,omitempty"`
+}
+
+// taskMetadata is the task metadata v4 response format.
+type taskMetadata struct {
+	Cluster          string              `json:"Cluster"`
+	TaskARN          string              `json:"TaskARN"`
+	Family           string              `json:"Family"`
+	Revision         string              `json:"Revision"`
+	DesiredStatus    string              `json:"DesiredStatus"`
+	KnownStatus      string              `json:"KnownStatus"`
+	Limits           containerLimits     `json:"Limits"`
+	PullStartedAt    string              `json:"PullStartedAt"`
+	PullStoppedAt    string              `json:"PullStoppedAt"`
+	AvailabilityZone string              `json:"AvailabilityZone"`
+	LaunchType       string              `json:"LaunchType"`
+	Containers       []containerMetadata `json:"Containers"`
+}
+
+// containerMetadata is the container metadata v4 response format.
+type containerMetadata struct {
+	DockerID      string             `json:"DockerId"`
+	Name          string             `json:"Name"`
+	DockerName    string             `json:"DockerName"`
+	Image         string             `json:"Image"`
+	ImageID       string             `json:"ImageID"`
+	Labels        map[string]string  `json:"Labels"`
+	DesiredStatus string             `json:"DesiredStatus"`
+	KnownStatus   string             `json:"KnownStatus"`
+	Limits        containerLimits    `json:"Limits"`
+	CreatedAt     string             `json:"CreatedAt"`
+	StartedAt     string             `json:"StartedAt"`
+	Type          string             `json:"Type"`
+	ContainerARN  string             `json:"ContainerARN"`
+	Networks      []containerNetwork `json:"Networks"`
+}
+
+type containerLimits struct {
+	CPU    float64 `json:"CPU"`
+	Memory int     `json:"Memory"`
+}
+
+type containerNetwork struct {
+	NetworkMode   string   `json:"NetworkMode"`
+	IPv4Addresses []string `json:"IPv4Addresses"`
+}
+
+// containerStats is the subset of the Docker stats format served by the
+// stats endpoints.  Only the configured limits are known; usage counters
+// are reported as zero.
+type containerStats struct {
+	Read        string `json:"read"`
+	PreRead     string `json:"preread"`
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	NumProcs    int    `json:"num_procs"`
+	MemoryStats struct {
+		Usage uint64 `json:"usage"`
+		Limit uint64 `json:"limit"`
+	} `json:"memory_stats"`
+	CPUStats struct {
+		OnlineCPUs int `json:"online_cpus"`
+	} `json:"cpu_stats"`
+}
+
+func loadTaskDefinition(path string) (*taskDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var def taskDefinition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return nil, fmt.Errorf("cannot parse container definitions %s: %w", path, err)
+	}
+	for i, c := range def.Containers {
+		if c.ID == "" || c.Name == "" {
+			return nil, fmt.Errorf(
+				"container definitions %s: entry %d: id and name are required", path, i)
+		}
+	}
+	return &def, nil
+}
+
+// taskDefinitionFile serves the parsed container definitions file, which
+// is read again only when its modification time or size changes.  If the
+// new contents cannot be read or parsed, the previous definitions are
+// kept.
+type taskDefinitionFile struct {
+	path     string
+	snapshot atomic.Pointer[taskDefinitionSnapshot]
+}
+
+type taskDefinitionSnapshot struct {
+	def   *taskDefinition
+	stamp fileStamp
+}
+
+func (f *taskDefinitionFile) get() (*taskDefinition, error) {
+	// The file is stamped before reading, so that a change while it is
+	// read is picked up by the next call.
+	stamp := stampFile(f.path)
+	prev := f.snapshot.Load()
+	if prev != nil && prev.stamp == stamp {
+		return prev.def, nil
+	}
+	def, err := loadTaskDefinition(f.path)
+	if err != nil {
+		if prev != nil {
+			klog.Errorf("keeping previous container definitions: %v", err)
+			return prev.def, nil
+		}
+		return nil, err
+	}
+	f.snapshot.Store(&taskDefinitionSnapshot{def: def, stamp: stamp})
+	return def, nil
+}
+
+// taskMetadataHandler serves /v4/<id>, /v4/<id>/task, /v4/<id>/stats and
+// /v4/<id>/task/stats for the containers in defs.
+func (s *Server) taskMetadataHandler(defs *taskDefinitionFile) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.serveTaskMetadata(w, r, defs)
+	}
+}
+
+func (s *Server) serveTaskMetadata(w http.ResponseWriter, r *http.Request, defs *taskDefinitionFile) {
+	parts := strings.SplitN(
+		strings.TrimPrefix(r.URL.Path, taskMetadataPrefix), "/", 2)
+	id, rest := parts[0], ""
+	if len(parts) == 2 {
+		rest = strings.TrimSuffix(parts[1], "/")
+	}
+
+	def, err := defs.get()
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+	task, err := s.buildTaskMetadata(def)
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+
+	var container *containerMetadata
+	for i := range task.Containers {
+		if task.Containers[i].DockerID == id {
+			container = &task.Containers[i]
+		}
+	}
+	if container == nil {
+		writeContainerError(w, http.StatusNotFound,
+			"NotFound", fmt.Sprintf("unknown container %q", id))
+		return
+	}
+
+	var resp interface{}
+	switch rest {
+	case "":
+		resp = container
+	case "task":
+		resp = task
+	case "stats":
+		resp = s.containerStats(container)
+	case "task/stats":
+		stats := make(map[string]*containerStats, len(task.Containers))
+		for i := range task.Containers {
+			stats[task.Containers[i].DockerID] = s.containerStats(&task.Containers[i])
+		}
+		resp = stats
+	default:
+		writeContainerError(w, http.StatusNotFound, "NotFound", "not found")
+		return
+	}
+
+	data, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+	fmt.Fprintf(w, "%s", data)
+}
+
+// buildTaskMetadata fills in the task metadata for def from the instance
+// data.
+func (s *Server) buildTaskMetadata(def *taskDefinition) (*taskMetadata, error) {
+	md, err := s.getMetadata("v1.region", "v1.availability_zone", "v1.instance_id")
+	if err != nil {
+		return nil, err
+	}
+	region, az, instID := md.V1.Region, md.V1.AvailabilityZone, md.V1.InstanceID
+
+	cluster := def.Cluster
+	if cluster == "" {
+		cluster = "default"
+	}
+	taskID := def.TaskID
+	if taskID == "" {
+		taskID = strings.TrimPrefix(instID, "i-")
+	}
+	family := def.Family
+	if family == "" {
+		family = cluster
+	}
+	revision := def.Revision
+	if revision == "" {
+		revision = "1"
+	}
+	launchType := def.LaunchType
+	if launchType == "" {
+		launchType = "EC2"
+	}
+	arnPrefix := fmt.Sprintf("arn:aws:ecs:%s:%s:", region, s.options.AccountID)
+	started := s.startTime.UTC().Format(time.RFC3339Nano)
+
+	task := &taskMetadata{
+		Cluster:          cluster,
+		TaskARN:          arnPrefix + "task/" + cluster + "/" + taskID,
+		Family:           family,
+		Revision:         revision,
+		DesiredStatus:    "RUNNING",
+		KnownStatus:      "RUNNING",
+		PullStartedAt:    started,
+		PullStoppedAt:    started,
+		AvailabilityZone: az,
+		LaunchType:       launchType,
+		Containers:       make([]containerMetadata, 0, len(def.Containers)),
+	}
+	for _, c := range def.Containers {
+		dockerName := c.DockerName
+		if dockerName == "" {
+			dockerName = c.Name
+		}
+		networkMode := c.NetworkMode
+		if networkMode == "" {
+			networkMode = "bridge"
+		}
+		labels := map[string]string{
+			"com.amazonaws.ecs.cluster":                 cluster,
+			"com.amazonaws.ecs.container-name":          c.Name,
+			"com.amazonaws.ecs.task-arn":                task.TaskARN,
+			"com.amazonaws.ecs.task-definition-family":  family,
+			"com.amazonaws.ecs.task-definition-version": revision,
+		}
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		limits := containerLimits{CPU: float64(c.CPU), Memory: c.Memory}
+		task.Limits.CPU += limits.CPU / 1024
+		task.Limits.Memory += limits.Memory
+
+		task.Containers = append(task.Containers, containerMetadata{
+			DockerID:      c.ID,
+			Name:          c.Name,
+			DockerName:    dockerName,
+			Image:         c.Image,
+			ImageID:       c.ImageID,
+			Labels:        labels,
+			DesiredStatus: "RUNNING",
+			KnownStatus:   "RUNNING",
+			Limits:        limits,
+			CreatedAt:     started,
+			StartedAt:     started,
+			Type:          "NORMAL",
+			ContainerARN:  arnPrefix + "container/" + cluster + "/" + taskID + "/" + c.ID,
+			Networks: []containerNetwork{{
+				NetworkMode:   networkMode,
+				IPv4Addresses: c.IPv4,
+			}},
+		})
+	}
+	return task, nil
+}
+
+func (s *Server) containerStats(c *containerMetadata) *containerStats {
+	now := time.Now().UTC()
+	stats := &containerStats{
+		Read:    now.Format(time.RFC3339Nano),
+		PreRead: now.Add(-time.Second).Format(time.RFC3339Nano),
+		Name:    "/" + c.DockerName,
+		ID:      c.DockerID,
+	}
+	stats.MemoryStats.Limit = uint64(c.Limits.Memory) * 1024 * 1024
+	stats.CPUStats.OnlineCPUs = int((c.Limits.CPU + 1023) / 1024)
+	return stats
+}
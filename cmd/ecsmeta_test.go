@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTaskMetadataTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "containers.json")
+	err := os.WriteFile(path, []byte(`{
+		"cluster": "vm-cluster",
+		"family": "shop",
+		"containers": [
+			{"id": "c1", "name": "api", "image": "shop/api:1", "cpu": 512, "memory": 256,
+			 "labels": {"team": "shop"}, "ipv4_addresses": ["172.17.0.2"]},
+			{"id": "c2", "name": "sidecar", "cpu": 256, "memory": 128}
+		]
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServerWithIAM(t, baseTestData())
+	s.options.ECSContainerDefinitionsFile = path
+	return s.ContainerHandler("secret-token")
+}
+
+func getTaskMetadata(t *testing.T, h http.Handler, path string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: bad JSON: %v", path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestTaskMetadataContainer(t *testing.T) {
+	h := newTaskMetadataTestServer(t)
+
+	var c containerMetadata
+	if code := getTaskMetadata(t, h, "/v4/c1", &c); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if c.Name != "api" || c.Image != "shop/api:1" || c.Limits.CPU != 512 || c.Limits.Memory != 256 {
+		t.Errorf("unexpected container %+v", c)
+	}
+	if c.Labels["team"] != "shop" || c.Labels["com.amazonaws.ecs.cluster"] != "vm-cluster" {
+		t.Errorf("unexpected labels %v", c.Labels)
+	}
+	if c.ContainerARN != "arn:aws:ecs:us-west-2:123456789012:container/vm-cluster/test-1234/c1" {
+		t.Errorf("unexpected ContainerARN %q", c.ContainerARN)
+	}
+
+	if code := getTaskMetadata(t, h, "/v4/unknown", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown container, got %d", code)
+	}
+}
+
+func TestTaskMetadataTask(t *testing.T) {
+	h := newTaskMetadataTestServer(t)
+
+	var task taskMetadata
+	if code := getTaskMetadata(t, h, "/v4/c2/task", &task); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if task.TaskARN != "arn:aws:ecs:us-west-2:123456789012:task/vm-cluster/test-1234" {
+		t.Errorf("unexpected TaskARN %q", task.TaskARN)
+	}
+	if task.AvailabilityZone != "us-west-2a" || task.Family != "shop" || task.LaunchType != "EC2" {
+		t.Errorf("unexpected task %+v", task)
+	}
+	if task.Limits.CPU != 0.75 || task.Limits.Memory != 384 || len(task.Containers) != 2 {
+		t.Errorf("unexpected task limits %+v with %d containers", task.Limits, len(task.Containers))
+	}
+}
+
+func TestTaskMetadataStats(t *testing.T) {
+	h := newTaskMetadataTestServer(t)
+
+	var stats containerStats
+	if code := getTaskMetadata(t, h, "/v4/c1/stats", &stats); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if stats.MemoryStats.Limit != 256*1024*1024 || stats.CPUStats.OnlineCPUs != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var all map[string]containerStats
+	if code := getTaskMetadata(t, h, "/v4/c1/task/stats", &all); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(all) != 2 || all["c2"].Name != "/sidecar" {
+		t.Errorf("unexpected task stats %+v", all)
+	}
+}
+
+func TestTaskMetadataDisabled(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	h := s.ContainerHandler("secret-token")
+	if code := getTaskMetadata(t, h, "/v4/c1", nil); code != http.StatusNotFound {
+		t.Errorf("expected 404 without container definitions, got %d", code)
+	}
+}
+
+func TestTaskMetadataListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "containers.json")
+	if err := os.WriteFile(path, []byte(`{"containers": [{"id": "c1", "name": "api"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServerWithIAM(t, baseTestData())
+	s.options.ECSContainerDefinitionsFile = path
+	h := s.TaskMetadataHandler()
+
+	var c containerMetadata
+	if code := getTaskMetadata(t, h, "/v4/c1", &c); code != http.StatusOK || c.Name != "api" {
+		t.Fatalf("expected container api without a token, got %d %+v", code, c)
+	}
+	if code := getTaskMetadata(t, h, "/v2/credentials", nil); code != http.StatusNotFound {
+		t.Errorf("expected no credentials on the task metadata listener, got %d", code)
+	}
+
+	// A rewritten file is picked up, and a broken one ignored.
+	if err := os.WriteFile(path, []byte(`{"containers": [{"id": "c1", "name": "api-v2"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if getTaskMetadata(t, h, "/v4/c1", &c); c.Name != "api-v2" {
+		t.Errorf("expected reloaded definitions, got %+v", c)
+	}
+	if err := os.WriteFile(path, []byte(`{"containers": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := getTaskMetadata(t, h, "/v4/c1", &c); code != http.StatusOK || c.Name != "api-v2" {
+		t.Errorf("expected previous definitions, got %d %+v", code, c)
+	}
+}
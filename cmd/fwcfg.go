@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// fwCfgInstanceData reads instance data that the host passed to a QEMU
+// guest as a fw_cfg entry, e.g. with
+//
+//	-fw_cfg name=opt/com.example/imds,file=imds.json
+//
+// which the qemu_fw_cfg driver exposes as
+// /sys/firmware/qemu_fw_cfg/by_name/opt/com.example/imds/raw.
+//
+// The entry holds a JSON object, either in the instance-data.json layout
+// (with v1 or ds keys) or as imds.<key> settings without the prefix, as
+// read by imdsSettingsData, with tags as an object:
+//
+//	{"instance_type": "m5.large", "az": "lab-1a", "tags": {"Team": "infra"},
+//	 "ds.meta_data.iam": {"role-name": "lab", "credentials": {...}}}
+//
+// fw_cfg entries cannot change while the guest runs, so the entry is read
+// until it has been parsed once; until then, e.g. because the driver is
+// not loaded yet, reads fail.
+type fwCfgInstanceData struct {
+	path string
+	snap atomic.Pointer[instanceDataSnapshot]
+}
+
+// fwCfgPath returns the sysfs file of the fw_cfg entry name.
+func fwCfgPath(sysfsRoot, name string) string {
+	return filepath.Join(sysfsRoot, "firmware", "qemu_fw_cfg", "by_name", name, "raw")
+}
+
+func newFwCfgInstanceData(sysfsRoot, name string) *fwCfgInstanceData {
+	return &fwCfgInstanceData{path: fwCfgPath(sysfsRoot, name)}
+}
+
+func (f *fwCfgInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	if snap := f.snap.Load(); snap != nil {
+		return snap, nil
+	}
+
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	// Concurrent first reads may both parse the entry; the first snapshot
+	// stored wins, so that all callers see the same version.
+	f.snap.CompareAndSwap(nil, newInstanceDataSnapshot(fwCfgDocumentData(doc)))
+	return f.snap.Load(), nil
+}
+
+// fwCfgDocumentData returns the instance data in doc.
+func fwCfgDocumentData(doc map[string]interface{}) map[string]interface{} {
+	if _, found := doc["v1"]; found {
+		return doc
+	}
+	if _, found := doc["ds"]; found {
+		return doc
+	}
+
+	settings := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		if tags, ok := value.(map[string]interface{}); ok && key == "tags" {
+			for name, tag := range tags {
+				settings["tag."+name] = tag
+			}
+			continue
+		}
+		settings[key] = value
+	}
+	return imdsSettingsData(settings)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFwCfgInstanceData(t *testing.T) {
+	root := t.TempDir()
+	f := newFwCfgInstanceData(root, "opt/com.example/imds")
+	if _, err := f.GetInstanceData(); err == nil {
+		t.Fatal("expected error before the entry exists")
+	}
+
+	writeTestFile(t, root, "firmware/qemu_fw_cfg/by_name/opt/com.example/imds/raw", `{
+		"instance_id": "i-vm1",
+		"az": "lab-1a",
+		"tags": {"Team": "infra"},
+		"ds.meta_data.iam": {"role-name": "lab"}
+	}`)
+	snap, err := f.GetInstanceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"v1": map[string]interface{}{
+			"instance_id":       "i-vm1",
+			"availability_zone": "lab-1a",
+		},
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"tags": map[string]interface{}{"Team": "infra"},
+			"iam":  map[string]interface{}{"role-name": "lab"},
+		}},
+	}
+	if !reflect.DeepEqual(snap.data, want) {
+		t.Errorf("expected %v, got %v", want, snap.data)
+	}
+
+	// The entry does not change while the guest runs.
+	writeTestFile(t, root, "firmware/qemu_fw_cfg/by_name/opt/com.example/imds/raw", `{}`)
+	if again, _ := f.GetInstanceData(); again != snap {
+		t.Errorf("expected the entry to be read once, got %v", again.data)
+	}
+}
+
+func TestFwCfgInstanceDataLayout(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "firmware/qemu_fw_cfg/by_name/opt/imds/raw", `{
+		"v1": {"instance_id": "i-vm2"},
+		"ds": {"meta_data": {"instance_type": "m5.large"}}
+	}`)
+	writeTestFile(t, root, "firmware/qemu_fw_cfg/by_name/opt/broken/raw", `{"v1": `)
+
+	src := newFwCfgInstanceData(root, "opt/imds")
+	if instanceTypeOf(t, src) != "m5.large" {
+		t.Errorf("expected instance-data.json layout to be used as is, got %v", src.snap.Load().data)
+	}
+	if _, err := newFwCfgInstanceData(root, "opt/broken").GetInstanceData(); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
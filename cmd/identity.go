@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// identityCredentialsName is the only entry under
+	// identity-credentials/ec2/security-credentials/.
+	identityCredentialsName = "ec2-instance"
+
+	identityProvName = "IdentityCredentialsProvider"
+)
+
+// identityInfoResponse is the identity-credentials/ec2/info format.
+type identityInfoResponse struct {
+	Code        string `json:"Code"`
+	LastUpdated string `json:"LastUpdated"`
+	AccountID   string `json:"AccountId"`
+}
+
+// errNoIdentityCredentials is returned by metadataIdentityProvider while
+// the instance data has no identity credentials.
+var errNoIdentityCredentials = errors.New("identity_credentials missing from metadata")
+
+// startIdentityCredentials starts the refresh loop for the instance
+// identity credentials.  They are minted by the offline STS when the
+// offline credential source is used and read from
+// ds.meta_data.identity_credentials otherwise.  Until they are available
+// the identity-credentials paths return 404; the loop keeps retrying, so
+// that instance data written after startup is picked up.
+func (s *Server) startIdentityCredentials() {
+	var provider credentials.Provider
+	if s.offlineSTS != nil {
+		provider = &offlineIdentityProvider{
+			offlineProvider: offlineProvider{
+				sts: s.offlineSTS,
+				roleArn: fmt.Sprintf("arn:aws:iam::%s:role/aws:ec2-instance",
+					s.options.AccountID),
+			},
+			server: s,
+		}
+	} else {
+		provider = &metadataIdentityProvider{server: s}
+	}
+
+	go s.refreshLoop("identity credentials",
+		refreshingFetcher(credentials.NewCredentials(provider)),
+		s.publishIdentityCredentials)
+}
+
+// offlineIdentityProvider mints identity credentials with the instance ID
+// as the session name, which is looked up on every retrieval.
+type offlineIdentityProvider struct {
+	offlineProvider
+
+	server *Server
+}
+
+func (p *offlineIdentityProvider) Retrieve() (credentials.Value, error) {
+	md, err := p.server.getMetadata("v1.instance_id")
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	p.sessionName = md.V1.InstanceID
+	return p.offlineProvider.Retrieve()
+}
+
+// publishIdentityCredentials makes creds the served identity credentials.
+func (s *Server) publishIdentityCredentials(creds *credentials.Credentials) error {
+	imdsCreds, err := imdsCredentialsFrom(creds)
+	if err != nil {
+		return err
+	}
+
+	s.identityMu.Lock()
+	defer s.identityMu.Unlock()
+	s.identityCreds = imdsCreds
+	return nil
+}
+
+// getIdentityCredentials returns the current identity credentials, or nil
+// if there are none.
+func (s *Server) getIdentityCredentials() *IMDSCredentials {
+	s.identityMu.RLock()
+	defer s.identityMu.RUnlock()
+	return s.identityCreds
+}
+
+// getMetadataIdentityCredentials returns ds.meta_data.identity_credentials,
+// or nil if it is not set.
+func (s *Server) getMetadataIdentityCredentials() (*metadataCredentials, error) {
+	md, err := s.getMetadata("ds.meta_data.identity_credentials")
+	if err != nil {
+		return nil, err
+	}
+	return md.DS.IdentityCredentials, nil
+}
+
+// metadataIdentityProvider reads the identity credentials from instance
+// data on every retrieval, so that updates to the data source are picked
+// up by the refresh loop.
+type metadataIdentityProvider struct {
+	credentials.Expiry
+
+	server *Server
+}
+
+func (p *metadataIdentityProvider) Retrieve() (credentials.Value, error) {
+	creds, err := p.server.getMetadataIdentityCredentials()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if creds == nil {
+		return credentials.Value{}, errNoIdentityCredentials
+	}
+
+	val := credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		ProviderName:    identityProvName,
+	}
+
+	if expiresAt, err := time.Parse(time.RFC3339, creds.Expiration); err == nil {
+		p.SetExpiration(expiresAt, 0)
+	} else {
+		p.SetExpiration(time.Time{}, 0)
+	}
+	klog.Info("loaded identity credentials from metadata")
+	return val, nil
+}
+
+func (s *Server) identityInfoHandler(w http.ResponseWriter, _ *http.Request) {
+	creds := s.getIdentityCredentials()
+	if creds == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.MarshalIndent(identityInfoResponse{
+		Code:        "Success",
+		LastUpdated: creds.LastUpdated,
+		AccountID:   s.options.AccountID,
+	}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%s", data)
+}
+
+func (s *Server) identityCredentialsListHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.getIdentityCredentials() == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "%s", identityCredentialsName)
+}
+
+func (s *Server) identityCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/latest/meta-data/identity-credentials/ec2/security-credentials/"
+	if r.URL.Path == prefix {
+		auditRecordFrom(r).skip()
+		s.identityCredentialsListHandler(w, r)
+		return
+	}
+	auditRecordFrom(r).setRole(&servedRole{name: identityCredentialsName})
+
+	creds := s.getIdentityCredentials()
+	if creds == nil || r.URL.Path != prefix+identityCredentialsName {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditRecordFrom(r).setAccessKeyID(creds.AccessKeyID)
+	fmt.Fprintf(w, "%s", data)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func publishTestIdentity(t *testing.T, s *Server, p credentials.Provider) {
+	t.Helper()
+	creds, err := refreshingFetcher(credentials.NewCredentials(p))()
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if err := s.publishIdentityCredentials(creds); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+}
+
+func TestIdentityCredentialsFromMetadata(t *testing.T) {
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["identity_credentials"] = map[string]interface{}{
+		"AccessKeyId":     "ASIAIDENTITY",
+		"SecretAccessKey": "idsecret",
+		"Token":           "idtoken",
+		"Expiration":      "2099-01-01T00:00:00Z",
+	}
+	s := newTestServerWithIAM(t, data)
+	publishTestIdentity(t, s, &metadataIdentityProvider{server: s})
+	h := s.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET",
+		"/latest/meta-data/identity-credentials/ec2/security-credentials/", nil))
+	if w.Body.String() != "ec2-instance" {
+		t.Errorf("expected ec2-instance, got %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET",
+		"/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var creds IMDSCredentials
+	if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if creds.AccessKeyID != "ASIAIDENTITY" || creds.Token != "idtoken" ||
+		creds.Expiration != "2099-01-01T00:00:00Z" || creds.Code != "Success" {
+		t.Errorf("unexpected identity credentials %+v", creds)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET",
+		"/latest/meta-data/identity-credentials/ec2/info", nil))
+	var info identityInfoResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if info.AccountID != "123456789012" || info.Code != "Success" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// The role credentials are untouched.
+	if _, imdsCreds := s.getIMDSCredentials(); imdsCreds.AccessKeyID != "AKIATEST" {
+		t.Errorf("role credentials changed to %+v", imdsCreds)
+	}
+}
+
+func TestIdentityCredentialsOffline(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	s.offlineSTS = newOfflineSTS("123456789012", time.Hour)
+	publishTestIdentity(t, s, &offlineProvider{
+		sts:         s.offlineSTS,
+		roleArn:     "arn:aws:iam::123456789012:role/aws:ec2-instance",
+		sessionName: "i-test-1234",
+	})
+
+	creds := s.getIdentityCredentials()
+	if creds == nil {
+		t.Fatal("expected identity credentials")
+	}
+	sess, ok := s.offlineSTS.lookup(creds.AccessKeyID)
+	if !ok {
+		t.Fatal("identity credentials not known to the offline STS")
+	}
+	if sess.AssumedRoleArn != "arn:aws:sts::123456789012:assumed-role/ec2-instance/i-test-1234" {
+		t.Errorf("unexpected assumed role %q", sess.AssumedRoleArn)
+	}
+}
+
+func TestIdentityCredentialsMissing(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	s.startIdentityCredentials()
+
+	for _, path := range []string{
+		"/latest/meta-data/identity-credentials/ec2/info",
+		"/latest/meta-data/identity-credentials/ec2/security-credentials",
+		"/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance",
+	} {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+}
+
+// Identity credentials missing at startup, or instance data not written
+// yet, must not fail startup and are picked up once they appear.
+func TestIdentityCredentialsAppearLater(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	s.dataSource = &mockInstanceData{err: errors.New("not written yet")}
+	p := &metadataIdentityProvider{server: s}
+	if _, err := p.Retrieve(); err == nil {
+		t.Fatal("expected error without instance data")
+	}
+
+	data := baseTestData()
+	s.dataSource = &mockInstanceData{data: data}
+	if _, err := p.Retrieve(); !errors.Is(err, errNoIdentityCredentials) {
+		t.Fatalf("expected errNoIdentityCredentials, got %v", err)
+	}
+
+	data = baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["identity_credentials"] = map[string]interface{}{
+		"AccessKeyId":     "ASIALATE",
+		"SecretAccessKey": "idsecret",
+		"Expiration":      "2099-01-01T00:00:00Z",
+	}
+	s.dataSource = &mockInstanceData{data: data}
+	publishTestIdentity(t, s, p)
+	if creds := s.getIdentityCredentials(); creds == nil || creds.AccessKeyID != "ASIALATE" {
+		t.Errorf("unexpected identity credentials %+v", creds)
+	}
+}
+
+func TestOfflineIdentityCredentialsWithoutInstanceData(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	s.offlineSTS = newOfflineSTS("123456789012", time.Hour)
+	s.dataSource = &mockInstanceData{err: errors.New("not written yet")}
+	p := &offlineIdentityProvider{
+		offlineProvider: offlineProvider{sts: s.offlineSTS, roleArn: "arn:aws:iam::123456789012:role/aws:ec2-instance"},
+		server:          s,
+	}
+	if _, err := p.Retrieve(); err == nil {
+		t.Fatal("expected error without instance data")
+	}
+
+	s.dataSource = &mockInstanceData{data: baseTestData()}
+	publishTestIdentity(t, s, p)
+	sess, ok := s.offlineSTS.lookup(s.getIdentityCredentials().AccessKeyID)
+	if !ok || sess.AssumedRoleArn != "arn:aws:sts::123456789012:assumed-role/ec2-instance/i-test-1234" {
+		t.Errorf("unexpected session %+v", sess)
+	}
+}
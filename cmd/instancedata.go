@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+// fileInstanceData serves a parsed snapshot of a cloud-init instance-data
+// file, or of a YAML or JSON file in the same format.  The snapshot is
+// immutable and is swapped atomically when the file changes; if the new
+// contents cannot be read or parsed, e.g. because the file is mid-write,
+// the previous snapshot is kept.  Callers must not modify the returned
+// map.
+//
+// cloud-init replaces sensitive values in the world-readable file with
+// redactedPlaceholder and writes the real ones to a root-only file.  If
+// sensitivePath is set and readable, it is merged over path.
+//
+// Changes are picked up through inotify when watching was started by
+// newFileInstanceData, and by comparing the files' modification time and
+// size on every read otherwise.
+type fileInstanceData struct {
+	path          string
+	sensitivePath string
+
+	snapshot atomic.Pointer[instanceDataSnapshot]
+	watcher  io.Closer
+	watching atomic.Bool
+}
+
+// redactedPlaceholder is what cloud-init writes in place of sensitive
+// values in instance-data.json.
+const redactedPlaceholder = "redacted for non-root user"
+
+// instanceDataSnapshot is a version of the instance data of a source.
+// Its data must not be modified.
+type instanceDataSnapshot struct {
+	data map[string]interface{}
+	// version is unique to the snapshot, across all sources.
+	version uint64
+	// files are the versions of the files data was read from, for the
+	// sources reading files.
+	files []fileStamp
+}
+
+// snapshotVersion is the version of the latest snapshot created.
+var snapshotVersion atomic.Uint64
+
+// newInstanceDataSnapshot returns a snapshot of data with a new version.
+func newInstanceDataSnapshot(data map[string]interface{}) *instanceDataSnapshot {
+	return &instanceDataSnapshot{data: data, version: snapshotVersion.Add(1)}
+}
+
+// fileStamp identifies the version of a file a snapshot was read from.
+type fileStamp struct {
+	path    string
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func stampFile(path string) fileStamp {
+	st, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{path: path}
+	}
+	return fileStamp{path: path, exists: true, modTime: st.ModTime(), size: st.Size()}
+}
+
+// newFileInstanceData returns a fileInstanceData for path, and optionally
+// sensitivePath in the same directory, that reloads them when their
+// directory reports a change.  If the directory cannot be watched,
+// changes are detected on read instead.
+func newFileInstanceData(path, sensitivePath string) *fileInstanceData {
+	// Compared with the cleaned paths the watcher reports.
+	path = filepath.Clean(path)
+	if sensitivePath != "" {
+		sensitivePath = filepath.Clean(sensitivePath)
+	}
+	f := &fileInstanceData{path: path, sensitivePath: sensitivePath}
+	watcher, err := watchDir(filepath.Dir(path), func(name string) {
+		switch name {
+		case "":
+			f.watching.Store(false)
+		case path, sensitivePath, filepath.Dir(path):
+			f.reload()
+		}
+	})
+	if err != nil {
+		klog.Warningf("cannot watch %s, checking it on every request: %v", path, err)
+	} else {
+		f.watcher = watcher
+		f.watching.Store(true)
+	}
+	if _, err := f.reload(); err != nil {
+		klog.Warningf("instance data is not available yet: %v", err)
+	}
+	return f
+}
+
+// Close stops watching the file.
+func (f *fileInstanceData) Close() error {
+	if f.watcher == nil {
+		return nil
+	}
+	return f.watcher.Close()
+}
+
+func (f *fileInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	snap := f.snapshot.Load()
+	if snap != nil && (f.watching.Load() || !f.changed(snap)) {
+		return snap, nil
+	}
+	return f.reload()
+}
+
+// changed reports whether the files look different from when snap was
+// taken.
+func (f *fileInstanceData) changed(snap *instanceDataSnapshot) bool {
+	for _, stamp := range snap.files {
+		if stampFile(stamp.path) != stamp {
+			return true
+		}
+	}
+	return false
+}
+
+// reload parses the file and publishes it as the current snapshot.  On
+// failure the previous snapshot, if any, stays current and is returned.
+func (f *fileInstanceData) reload() (*instanceDataSnapshot, error) {
+	snap, err := f.load()
+	if err != nil {
+		if prev := f.snapshot.Load(); prev != nil {
+			klog.Errorf("keeping previous instance data: %v", err)
+			return prev, nil
+		}
+		klog.Errorf("%s\n", err.Error())
+		return nil, err
+	}
+	f.snapshot.Store(snap)
+	return snap, nil
+}
+
+func (f *fileInstanceData) load() (*instanceDataSnapshot, error) {
+	data, stamp, err := readDataFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	snap := newInstanceDataSnapshot(data)
+	snap.files = []fileStamp{stamp}
+	if f.sensitivePath == "" {
+		return snap, nil
+	}
+
+	sensitive, stamp, err := readDataFile(f.sensitivePath)
+	switch {
+	case err == nil:
+		snap.data = mergeInstanceData(data, sensitive, "", nil)
+	case errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission):
+		klog.V(2).Infof("not using sensitive instance data: %v", err)
+	default:
+		return nil, err
+	}
+	snap.files = append(snap.files, stamp)
+	return snap, nil
+}
+
+// readDataFile parses the object in path, as YAML if its extension is
+// .yaml or .yml and as JSON otherwise, and returns it along with the
+// stamp of the version read.  If the file cannot be opened, e.g. because
+// it is not readable, the stamp is that of the file as it is.
+func readDataFile(path string) (map[string]interface{}, fileStamp, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, stampFile(path), err
+	}
+	defer file.Close()
+
+	st, err := file.Stat()
+	if err != nil {
+		return nil, fileStamp{path: path}, err
+	}
+	stamp := fileStamp{path: path, exists: true, modTime: st.ModTime(), size: st.Size()}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, stamp, err
+	}
+	parsed := make(map[string]interface{})
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &parsed)
+	default:
+		err = json.Unmarshal(data, &parsed)
+	}
+	if err != nil {
+		return nil, stamp, fmt.Errorf("%s: %w", path, err)
+	}
+	return parsed, stamp, nil
+}
+
+// mergeInstanceData returns base with overlay merged over it: objects
+// present in both are merged key by key, and any other value in overlay
+// replaces the one in base.  Neither argument is modified.
+//
+// If conflicts is not nil, an object and a non-object value at the same
+// key conflict: the overlay value is not applied, and its dotted path,
+// below path, is recorded in conflicts instead.  null is not a conflict
+// and replaces any value.
+func mergeInstanceData(
+	base, overlay map[string]interface{},
+	path string,
+	conflicts *[]string,
+) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range overlay {
+		baseVal, found := result[k]
+		baseObj, baseIsObj := baseVal.(map[string]interface{})
+		overlayObj, overlayIsObj := v.(map[string]interface{})
+		switch {
+		case baseIsObj && overlayIsObj:
+			result[k] = mergeInstanceData(baseObj, overlayObj, joinFieldPath(path, k), conflicts)
+		case conflicts != nil && found && baseVal != nil && v != nil && baseIsObj != overlayIsObj:
+			*conflicts = append(*conflicts, joinFieldPath(path, k))
+		default:
+			result[k] = v
+		}
+	}
+	return result
+}
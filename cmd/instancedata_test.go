@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeInstanceData(t *testing.T, path, data string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func instanceIDOf(t *testing.T, f *fileInstanceData) string {
+	t.Helper()
+	snap, err := f.GetInstanceData()
+	if err != nil {
+		t.Fatalf("GetInstanceData: %v", err)
+	}
+	return snap.data["v1"].(map[string]interface{})["instance_id"].(string)
+}
+
+func waitForInstanceID(t *testing.T, f *fileInstanceData, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for instanceIDOf(t, f) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("instance data was not reloaded, still %q", instanceIDOf(t, f))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileInstanceDataSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance-data.json")
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-1"}}`)
+
+	f := newFileInstanceData(path, "")
+	t.Cleanup(func() { f.Close() })
+	if !f.watching.Load() {
+		t.Skip("file watching is not available")
+	}
+
+	first, _ := f.GetInstanceData()
+	second, _ := f.GetInstanceData()
+	if first.version != second.version {
+		t.Error("expected the same snapshot for unchanged file")
+	}
+
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-2"}}`)
+	waitForInstanceID(t, f, "i-2")
+
+	// A partial write is ignored and the previous snapshot kept.
+	if err := os.WriteFile(path, []byte(`{"v1": {"instance`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := instanceIDOf(t, f); got != "i-2" {
+		t.Errorf("expected previous snapshot after invalid write, got %q", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"v1": {"instance_id": "i-3"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForInstanceID(t, f, "i-3")
+}
+
+func TestFileInstanceDataUncleanPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instance-data.json")
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-1"}}`)
+
+	f := newFileInstanceData(dir+"//./instance-data.json", dir+"/./instance-data-sensitive.json")
+	t.Cleanup(func() { f.Close() })
+	if !f.watching.Load() {
+		t.Skip("file watching is not available")
+	}
+	if got := instanceIDOf(t, f); got != "i-1" {
+		t.Fatalf("expected i-1, got %q", got)
+	}
+
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-2"}}`)
+	waitForInstanceID(t, f, "i-2")
+}
+
+func TestFileInstanceDataWithoutWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance-data.json")
+	f := &fileInstanceData{path: path}
+	if _, err := f.GetInstanceData(); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-1"}}`)
+	if got := instanceIDOf(t, f); got != "i-1" {
+		t.Errorf("expected i-1, got %q", got)
+	}
+
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-22"}}`)
+	if got := instanceIDOf(t, f); got != "i-22" {
+		t.Errorf("expected reload on change, got %q", got)
+	}
+
+	writeInstanceData(t, path, `not json`)
+	if got := instanceIDOf(t, f); got != "i-22" {
+		t.Errorf("expected previous snapshot after invalid write, got %q", got)
+	}
+}
+
+func TestFileInstanceDataWatchEnds(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cloud-init")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "instance-data.json")
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-1"}}`)
+
+	f := newFileInstanceData(path, "")
+	if !f.watching.Load() {
+		t.Skip("file watching is not available")
+	}
+	f.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.watching.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("watch did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-22"}}`)
+	if got := instanceIDOf(t, f); got != "i-22" {
+		t.Errorf("expected fallback to checking on read, got %q", got)
+	}
+}
+
+func TestFileInstanceDataSensitive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instance-data.json")
+	sensitivePath := filepath.Join(dir, "instance-data-sensitive.json")
+	writeInstanceData(t, path, `{
+		"v1": {"instance_id": "i-1"},
+		"ds": {"meta_data": {"iam": {"credentials": "redacted for non-root user"}}}
+	}`)
+
+	f := &fileInstanceData{path: path, sensitivePath: sensitivePath}
+	snap, err := f.GetInstanceData()
+	if err != nil {
+		t.Fatalf("GetInstanceData without sensitive file: %v", err)
+	}
+	iam := snap.data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})["iam"]
+	if iam.(map[string]interface{})["credentials"] != redactedPlaceholder {
+		t.Errorf("expected redacted credentials, got %v", iam)
+	}
+
+	writeInstanceData(t, sensitivePath, `{
+		"ds": {"meta_data": {"iam": {"credentials": {"AccessKeyId": "AKIAREAL"}}}}
+	}`)
+	snap, err = f.GetInstanceData()
+	if err != nil {
+		t.Fatalf("GetInstanceData: %v", err)
+	}
+	md := snap.data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	creds := md["iam"].(map[string]interface{})["credentials"].(map[string]interface{})
+	if creds["AccessKeyId"] != "AKIAREAL" {
+		t.Errorf("expected sensitive credentials, got %v", creds)
+	}
+	if instanceIDOf(t, f) != "i-1" {
+		t.Error("expected public fields to be kept")
+	}
+}
+
+func TestFileInstanceDataSensitiveUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any file")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instance-data.json")
+	sensitivePath := filepath.Join(dir, "instance-data-sensitive.json")
+	writeInstanceData(t, path, `{"v1": {"instance_id": "i-1"}}`)
+	if err := os.WriteFile(sensitivePath, []byte(`{}`), 0o000); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fileInstanceData{path: path, sensitivePath: sensitivePath}
+	if _, err := f.GetInstanceData(); err != nil {
+		t.Fatalf("GetInstanceData: %v", err)
+	}
+	if f.changed(f.snapshot.Load()) {
+		t.Error("expected an unreadable sensitive file not to count as changed")
+	}
+}
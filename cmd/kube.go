@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKubeTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultKubeCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	defaultPodRoleAnnotation = "iam.amazonaws.com/role"
+
+	// kubePodCacheTTL bounds how long a pod lookup result is reused.
+	kubePodCacheTTL = 30 * time.Second
+)
+
+// kubeClient is a minimal Kubernetes API client authenticating with a
+// service account token.
+type kubeClient struct {
+	apiServer string
+	tokenFile string
+	client    *http.Client
+}
+
+// kubePodResolver resolves pods through the Kubernetes API by pod IP and
+// reads their role from an annotation.
+type kubePodResolver struct {
+	kube       *kubeClient
+	nodeName   string
+	annotation string
+	now        func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]kubePodCacheEntry
+}
+
+type kubePodCacheEntry struct {
+	pod     *podIdentity
+	expires time.Time
+}
+
+// kubePodList is the subset of a v1 PodList used here.
+type kubePodList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			HostNetwork bool `json:"hostNetwork"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// newKubeClient returns a client for -kube-api-server, or the in-cluster
+// API server if unset.
+func newKubeClient(opts *Options) (*kubeClient, error) {
+	apiServer := opts.KubeAPIServer
+	if apiServer == "" {
+		host := os.Getenv("KUBERNETES_SERVICE_HOST")
+		port := os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New(
+				"not running in a cluster, -kube-api-server is required")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.KubeCAFile != "" {
+		pem, err := os.ReadFile(opts.KubeCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.KubeCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &kubeClient{
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		tokenFile: opts.KubeTokenFile,
+		client:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// do sends a request with a JSON body (if in is non-nil) to the API server
+// and decodes the JSON response into out.
+func (k *kubeClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, k.apiServer+path, body)
+	if err != nil {
+		return err
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("kubernetes API returned status %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("cannot parse kubernetes API response: %w", err)
+	}
+	return nil
+}
+
+func newKubePodResolver(opts *Options) (*kubePodResolver, error) {
+	kube, err := newKubeClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	annotation := opts.PodRoleAnnotation
+	if annotation == "" {
+		annotation = defaultPodRoleAnnotation
+	}
+
+	return &kubePodResolver{
+		kube:       kube,
+		nodeName:   opts.KubeNodeName,
+		annotation: annotation,
+		now:        time.Now,
+		cache:      make(map[string]kubePodCacheEntry),
+	}, nil
+}
+
+func (k *kubePodResolver) ResolvePod(ip net.IP) (*podIdentity, error) {
+	key := ip.String()
+	k.mu.Lock()
+	entry, ok := k.cache[key]
+	k.mu.Unlock()
+	if ok && k.now().Before(entry.expires) {
+		return entry.pod, nil
+	}
+
+	pod, err := k.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	for ip, e := range k.cache {
+		if !now.Before(e.expires) {
+			delete(k.cache, ip)
+		}
+	}
+	k.cache[key] = kubePodCacheEntry{pod: pod, expires: now.Add(kubePodCacheTTL)}
+	return pod, nil
+}
+
+func (k *kubePodResolver) lookup(ip string) (*podIdentity, error) {
+	selector := "status.podIP=" + ip
+	if k.nodeName != "" {
+		selector += ",spec.nodeName=" + k.nodeName
+	}
+	var pods kubePodList
+	err := k.kube.do(http.MethodGet,
+		"/api/v1/pods?fieldSelector="+url.QueryEscape(selector), nil, &pods)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pods.Items {
+		// Host-network pods share the node address and must not be
+		// mistaken for the caller.
+		if p.Spec.HostNetwork || p.Status.Phase != "Running" {
+			continue
+		}
+		return &podIdentity{
+			Namespace: p.Metadata.Namespace,
+			Name:      p.Metadata.Name,
+			Role:      p.Metadata.Annotations[k.annotation],
+		}, nil
+	}
+	return nil, nil
+}
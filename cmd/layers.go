@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// newLayeredInstanceData layers, from lowest to highest precedence, the
+// SMBIOS data and the QEMU fw_cfg entry if enabled, the cloud-init
+// instance data (with the sensitive file next to it), the override files
+// in the order given and the drop-in files, if enabled, and the kernel
+// command line and environment overrides.
+func newLayeredInstanceData(options *Options, overrides []instanceDataOverride) *layeredInstanceData {
+	l := &layeredInstanceData{}
+	if options.DMI {
+		l.layers = append(l.layers, instanceDataLayer{
+			name:   "SMBIOS",
+			source: newDMIInstanceData(options.SysfsRoot),
+		})
+	}
+	if name := options.FwCfgEntry; name != "" {
+		l.layers = append(l.layers, instanceDataLayer{
+			name:   "fw_cfg " + name,
+			source: newFwCfgInstanceData(options.SysfsRoot, name),
+		})
+	}
+
+	path := options.InstanceData
+	sensitivePath := strings.TrimSuffix(path, ".json") + "-sensitive.json"
+	l.layers = append(l.layers, instanceDataLayer{
+		name:   path,
+		source: newFileInstanceData(path, sensitivePath),
+	})
+	for _, override := range options.InstanceDataOverrides {
+		l.layers = append(l.layers, instanceDataLayer{
+			name:   override,
+			source: newFileInstanceData(override, ""),
+		})
+	}
+	if dir := options.InstanceDataDir; dir != "" {
+		l.layers = append(l.layers, instanceDataLayer{name: dir, source: newDirInstanceData(dir)})
+	}
+	if len(overrides) != 0 {
+		l.layers = append(l.layers, instanceDataLayer{
+			name:   "overrides",
+			source: newOverrideInstanceData(overrides),
+		})
+	}
+	return l
+}
+
+// instanceDataLayer is one source of a layeredInstanceData, named for
+// logging.
+type instanceDataLayer struct {
+	name   string
+	source InstanceDataSource
+}
+
+// layeredInstanceData deep-merges the instance data of its layers, each
+// layer taking precedence over the ones before it: objects are merged key
+// by key, and any other value replaces the one below.  A value that would
+// replace an object with something other than an object, or the reverse,
+// is a conflict; it is logged and left out, and the rest of its layer
+// still applies.
+//
+// A layer that fails is logged and skipped, so that a broken override
+// file does not take the cloud-init data down with it.  Only if no layer
+// has data is an error returned.
+//
+// Layers are read on every call and reload themselves independently.  The
+// merged snapshot is only rebuilt when one of them returns a new snapshot,
+// so that callers caching by snapshot version, like getMetadata, keep
+// working.
+type layeredInstanceData struct {
+	layers []instanceDataLayer
+	merged atomic.Pointer[layeredSnapshot]
+}
+
+// layeredSnapshot is a merged snapshot along with the versions of the
+// layer snapshots it was merged from, 0 for layers that failed.
+type layeredSnapshot struct {
+	versions []uint64
+	snap     *instanceDataSnapshot
+}
+
+func (l *layeredInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	inputs := make([]*instanceDataSnapshot, len(l.layers))
+	versions := make([]uint64, len(l.layers))
+	var firstErr error
+	for i, layer := range l.layers {
+		snap, err := layer.source.GetInstanceData()
+		if err != nil {
+			klog.V(2).Infof("skipping instance data layer %s: %v", layer.name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		inputs[i], versions[i] = snap, snap.version
+	}
+
+	if prev := l.merged.Load(); prev != nil && slices.Equal(prev.versions, versions) {
+		return prev.snap, nil
+	}
+
+	var merged map[string]interface{}
+	for i, snap := range inputs {
+		if snap == nil {
+			continue
+		}
+		if merged == nil {
+			merged = snap.data
+			continue
+		}
+		var conflicts []string
+		merged = mergeInstanceData(merged, snap.data, "", &conflicts)
+		for _, path := range conflicts {
+			klog.Warningf("instance data layer %s: ignoring %s, which conflicts with the type of the layers below",
+				l.layers[i].name, path)
+		}
+	}
+	if merged == nil {
+		if firstErr == nil {
+			firstErr = errors.New("no instance data layers")
+		}
+		return nil, firstErr
+	}
+
+	snap := newInstanceDataSnapshot(merged)
+	l.merged.Store(&layeredSnapshot{versions: versions, snap: snap})
+	return snap, nil
+}
+
+// dropInPatterns are the files read from a drop-in directory.
+var dropInPatterns = []string{"*.yaml", "*.yml", "*.json"}
+
+// dirInstanceData layers the drop-in files of a directory in lexical
+// order of their names.  Each file is a fileInstanceData of its own, so
+// it is reloaded and fails independently of the others.
+//
+// A single inotify watch on the directory serves all files: a change to a
+// known file reloads just that file, and anything else (a file added or
+// removed, or lost events) makes the next read list the directory again.
+// Without a watch, the directory is listed and the files checked on every
+// read.
+type dirInstanceData struct {
+	dir string
+
+	watcher  io.Closer
+	watching atomic.Bool
+	dirty    atomic.Bool
+
+	mu     sync.Mutex
+	files  map[string]*fileInstanceData
+	layers *layeredInstanceData
+}
+
+// newDirInstanceData returns a dirInstanceData for dir, which need not
+// exist yet; files are only picked up once it does and, if it did not
+// exist when watching was attempted, without a watch.
+func newDirInstanceData(dir string) *dirInstanceData {
+	d := &dirInstanceData{dir: dir, files: map[string]*fileInstanceData{}}
+	d.dirty.Store(true)
+	watcher, err := watchDir(dir, d.changed)
+	if err != nil {
+		klog.V(2).Infof("cannot watch %s, listing it on every request: %v", dir, err)
+	} else {
+		d.watcher = watcher
+		d.watching.Store(true)
+	}
+	return d
+}
+
+func (d *dirInstanceData) changed(path string) {
+	if path == "" {
+		d.watching.Store(false)
+		d.mu.Lock()
+		for _, f := range d.files {
+			f.watching.Store(false)
+		}
+		d.mu.Unlock()
+		d.dirty.Store(true)
+		return
+	}
+
+	d.mu.Lock()
+	f := d.files[path]
+	if path == d.dir {
+		for _, f := range d.files {
+			f.reload()
+		}
+	}
+	d.mu.Unlock()
+	if f != nil && stampFile(path).exists {
+		f.reload()
+		return
+	}
+	d.dirty.Store(true)
+}
+
+// Close stops watching the directory.
+func (d *dirInstanceData) Close() error {
+	if d.watcher == nil {
+		return nil
+	}
+	return d.watcher.Close()
+}
+
+func (d *dirInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	if !d.watching.Load() || d.dirty.Swap(false) {
+		if err := d.list(); err != nil {
+			return nil, err
+		}
+	}
+	d.mu.Lock()
+	layers := d.layers
+	d.mu.Unlock()
+	if layers == nil {
+		return nil, fmt.Errorf("no drop-in files in %s", d.dir)
+	}
+	return layers.GetInstanceData()
+}
+
+// list picks up the drop-in files currently in the directory, keeping the
+// fileInstanceData of those already known.
+func (d *dirInstanceData) list() error {
+	var paths []string
+	for _, pattern := range dropInPatterns {
+		matches, err := filepath.Glob(filepath.Join(d.dir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, path := range matches {
+			if !strings.HasPrefix(filepath.Base(path), ".") {
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.layers != nil && len(d.layers.layers) == len(paths) {
+		same := true
+		for i, layer := range d.layers.layers {
+			same = same && layer.name == paths[i]
+		}
+		if same {
+			return nil
+		}
+	}
+
+	files := make(map[string]*fileInstanceData, len(paths))
+	layers := make([]instanceDataLayer, len(paths))
+	for i, path := range paths {
+		f := d.files[path]
+		if f == nil {
+			f = &fileInstanceData{path: path}
+			f.watching.Store(d.watching.Load())
+			f.reload()
+		}
+		files[path] = f
+		layers[i] = instanceDataLayer{name: path, source: f}
+	}
+	d.files = files
+	d.layers = nil
+	if len(layers) != 0 {
+		d.layers = &layeredInstanceData{layers: layers}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLayeredInstanceData(t *testing.T) {
+	base := &mockInstanceData{data: map[string]interface{}{
+		"v1": map[string]interface{}{"instance_id": "i-1", "region": "us-west-2"},
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"instance_type": "t3.micro",
+			"tags":          map[string]interface{}{"Team": "infra"},
+		}},
+	}}
+	override := &mockInstanceData{data: map[string]interface{}{
+		"v1": map[string]interface{}{"region": "eu-west-1"},
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"instance_type": "m5.large",
+			"tags":          "not an object",
+		}},
+	}}
+	broken := &mockInstanceData{err: errors.New("broken")}
+	top := &mockInstanceData{data: map[string]interface{}{
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"tags": map[string]interface{}{"Env": "lab"},
+		}},
+	}}
+	l := &layeredInstanceData{layers: []instanceDataLayer{
+		{name: "base", source: base},
+		{name: "override", source: override},
+		{name: "broken", source: broken},
+		{name: "top", source: top},
+	}}
+
+	snap, err := l.GetInstanceData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"v1": map[string]interface{}{"instance_id": "i-1", "region": "eu-west-1"},
+		"ds": map[string]interface{}{"meta_data": map[string]interface{}{
+			"instance_type": "m5.large",
+			"tags":          map[string]interface{}{"Team": "infra", "Env": "lab"},
+		}},
+	}
+	if !reflect.DeepEqual(snap.data, want) {
+		t.Errorf("expected %v, got %v", want, snap.data)
+	}
+	if base.data["v1"].(map[string]interface{})["region"] != "us-west-2" {
+		t.Error("merge modified a layer")
+	}
+
+	again, _ := l.GetInstanceData()
+	if again.version != snap.version {
+		t.Error("expected the merged data to be reused while no layer changed")
+	}
+	top.data, top.snap = map[string]interface{}{"v1": map[string]interface{}{"instance_id": "i-2"}}, nil
+	changed, _ := l.GetInstanceData()
+	if changed.version == snap.version || changed.data["v1"].(map[string]interface{})["instance_id"] != "i-2" {
+		t.Errorf("expected change in a layer to be merged, got %v", changed)
+	}
+
+	base.err, override.err, top.err = errors.New("gone"), errors.New("gone"), errors.New("gone")
+	if _, err := l.GetInstanceData(); err == nil || err.Error() != "gone" {
+		t.Errorf("expected the first error without any layer, got %v", err)
+	}
+}
+
+func TestReadDataFileYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "override.yaml")
+	writeInstanceData(t, path, "ds:\n  meta_data:\n    tags:\n      Team: infra\n")
+	data, _, err := readDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := decodeInstanceData(mergeInstanceData(baseTestData(), data, "", nil))
+	if md.DS.Tags["Team"] != "infra" || md.DS.Tags["Name"] != "test-instance" {
+		t.Errorf("unexpected tags %v", md.DS.Tags)
+	}
+}
+
+func instanceTypeOf(t *testing.T, src InstanceDataSource) string {
+	t.Helper()
+	snap, err := src.GetInstanceData()
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return snap.data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})["instance_type"].(string)
+}
+
+func waitForInstanceType(t *testing.T, src InstanceDataSource, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for instanceTypeOf(t, src) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected instance type %q, still %q", want, instanceTypeOf(t, src))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testDropInDir(t *testing.T, src InstanceDataSource, dir string) {
+	writeInstanceData(t, filepath.Join(dir, "10-type.yaml"), "ds: {meta_data: {instance_type: m5.large}}\n")
+	waitForInstanceType(t, src, "m5.large")
+
+	// Later files take precedence.
+	writeInstanceData(t, filepath.Join(dir, "20-type.json"), `{"ds": {"meta_data": {"instance_type": "c5.xlarge"}}}`)
+	waitForInstanceType(t, src, "c5.xlarge")
+
+	// An invalid file is skipped without affecting the others.
+	writeInstanceData(t, filepath.Join(dir, "30-broken.yaml"), "ds: [unterminated\n")
+	writeInstanceData(t, filepath.Join(dir, "15-type.yml"), "ds: {meta_data: {instance_type: r5.large}}\n")
+	writeInstanceData(t, filepath.Join(dir, "notes.txt"), "ds: {meta_data: {instance_type: ignored}}\n")
+	time.Sleep(50 * time.Millisecond)
+	if got := instanceTypeOf(t, src); got != "c5.xlarge" {
+		t.Errorf("expected c5.xlarge, got %q", got)
+	}
+
+	writeInstanceData(t, filepath.Join(dir, "10-type.yaml"), "ds: {meta_data: {instance_type: t3.nano}}\n")
+	if err := os.Remove(filepath.Join(dir, "20-type.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "15-type.yml")); err != nil {
+		t.Fatal(err)
+	}
+	waitForInstanceType(t, src, "t3.nano")
+}
+
+func TestDirInstanceData(t *testing.T) {
+	dir := t.TempDir()
+	d := newDirInstanceData(dir)
+	t.Cleanup(func() { d.Close() })
+	if !d.watching.Load() {
+		t.Skip("file watching is not available")
+	}
+	if _, err := d.GetInstanceData(); err == nil {
+		t.Error("expected error for empty directory")
+	}
+	testDropInDir(t, d, dir)
+}
+
+func TestDirInstanceDataWithoutWatch(t *testing.T) {
+	dir := t.TempDir()
+	testDropInDir(t, &dirInstanceData{dir: dir, files: map[string]*fileInstanceData{}}, dir)
+}
+
+func TestNewLayeredInstanceData(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instance-data.json")
+	writeInstanceData(t, path, `{"ds": {"meta_data": {"instance_type": "t2.micro"}}}`)
+	writeInstanceData(t, filepath.Join(dir, "instance-data-sensitive.json"),
+		`{"ds": {"meta_data": {"instance_type": "t3.micro"}}}`)
+	override := filepath.Join(dir, "override.yaml")
+	writeInstanceData(t, override, "ds: {meta_data: {instance_type: m5.large}}\n")
+
+	l := newLayeredInstanceData(&Options{
+		InstanceData:          path,
+		InstanceDataOverrides: []string{override},
+		InstanceDataDir:       filepath.Join(dir, "missing.d"),
+	}, nil)
+	if got := instanceTypeOf(t, l); got != "m5.large" {
+		t.Errorf("expected the override to win, got %q", got)
+	}
+	if err := os.Remove(override); err != nil {
+		t.Fatal(err)
+	}
+	l = newLayeredInstanceData(&Options{
+		InstanceData:          path,
+		InstanceDataOverrides: []string{override},
+	}, nil)
+	if got := instanceTypeOf(t, l); got != "t3.micro" {
+		t.Errorf("expected sensitive data without the override, got %q", got)
+	}
+}
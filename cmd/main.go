@@ -14,12 +14,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -27,6 +30,9 @@ import (
 
 const (
 	minRefreshInterval = 5 * time.Minute
+	credRetryInterval  = 30 * time.Second
+
+	imdsTokenHeader = "X-aws-ec2-metadata-token"
 )
 
 type IMDSCredentials struct {
@@ -39,26 +45,11 @@ type IMDSCredentials struct {
 	Type            string `json:"Type"`
 }
 
-// InstanceDataSource reads parsed instance metadata.
+// InstanceDataSource reads parsed instance metadata.  A source returns the
+// same snapshot until its data changes, so that callers can cache what
+// they derive from it by snapshot version.
 type InstanceDataSource interface {
-	GetInstanceData() (map[string]interface{}, error)
-}
-
-type fileInstanceData struct {
-	path string
-}
-
-func (f *fileInstanceData) GetInstanceData() (map[string]interface{}, error) {
-	data, err := os.ReadFile(f.path)
-	if err != nil {
-		klog.Errorf("%s\n", err.Error())
-		return nil, err
-	}
-	jsonMap := make(map[string]interface{})
-	if err := json.Unmarshal(data, &jsonMap); err != nil {
-		return nil, err
-	}
-	return jsonMap, nil
+	GetInstanceData() (*instanceDataSnapshot, error)
 }
 
 // NetworkInfo abstracts network interface lookups for testability.
@@ -129,34 +120,168 @@ type Server struct {
 	iamRoleArn string
 	iamCreds   *credentials.Credentials
 	imdsCreds  *IMDSCredentials
+
+	// Per-caller role selection; nil when every caller gets the instance
+	// role.
+	roleResolver RoleResolver
+	roleCache    *roleCredentialCache
+
+	// Instance identity credentials, independent of the instance
+	// profile and refreshed by their own loop.
+	identityMu    sync.RWMutex
+	identityCreds *IMDSCredentials
+
+	// offlineSTS mints credentials for the offline credential source.
+	offlineSTS *offlineSTS
+
+	// awsHTTPClient is used for AWS API calls; nil for the SDK default.
+	awsHTTPClient *http.Client
+
+	// audit records credential reads; nil when auditing is disabled.
+	// peers identifies local clients in audit entries.
+	audit *auditLog
+	peers PeerResolver
+
+	// pathMapping serves the paths of the -path-mapping-file; nil when
+	// every path is served by its built-in handler.
+	pathMapping *pathMapping
+
+	// overrides are the kernel command line and environment settings
+	// layered over the instance data.
+	overrides []instanceDataOverride
+
+	// overlay serves the files of the -overlay-dir; nil when disabled.
+	overlay *fileOverlay
+
+	// metadataCache holds the typed form of the last instance data
+	// snapshot.
+	metadataCache atomic.Pointer[decodedInstanceData]
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export-credentials":
+			os.Exit(runCredentialsCommand(os.Args[1], os.Args[2:],
+				credentialFormatEnv, os.Stdout, os.Stderr))
+		case "credential-process":
+			os.Exit(runCredentialsCommand(os.Args[1], os.Args[2:],
+				credentialFormatProcess, os.Stdout, os.Stderr))
+		}
+	}
+
 	fs := flag.NewFlagSet("nocloud-imds", flag.ExitOnError)
 	options := GetOptions(fs)
 
+	overrides, err := readOverrides(options.KernelCmdline, os.Environ())
+	if err != nil {
+		klog.Fatalf("could not read instance data overrides: %s", err)
+	}
+	logOverrides(overrides)
+
 	s := &Server{
-		dataSource: &fileInstanceData{
-			path: "/run/cloud-init/instance-data.json",
-		},
+		dataSource:   newLayeredInstanceData(options, overrides),
+		overrides:    overrides,
 		startTime:    time.Now().UTC(),
 		options:      options,
 		networkInfo:  realNetworkInfo{},
 		blockDevices: realBlockDeviceSource{},
 	}
+	s.roleCache = newRoleCredentialCache(s)
 
-	var err error
-	s.iamCreds, s.imdsCreds, s.iamRoleArn, err = s.getIAMCredentials()
+	if options.PathMappingFile != "" {
+		mapping, err := loadPathMapping(options.PathMappingFile)
+		if err != nil {
+			klog.Fatalf("could not load path mapping: %s", err)
+		}
+		s.pathMapping = mapping
+	}
+	if options.OverlayDir != "" {
+		s.overlay = newFileOverlay(options.OverlayDir)
+	}
+
+	awsHTTPClient, err := newAWSHTTPClient(options)
 	if err != nil {
-		klog.Fatalf(
-			"could not fetch IAM credentials from metadata: %s",
-			err,
-		)
+		klog.Fatalf("could not set up AWS HTTP client: %s", err)
+	}
+	s.awsHTTPClient = awsHTTPClient
+	if _, err := s.applyEndpointOptions(aws.NewConfig()); err != nil {
+		klog.Fatalf("invalid AWS endpoint options: %s", err)
+	}
+
+	if options.AuditLog != "" {
+		audit, err := openAuditLog(options.AuditLog,
+			options.AuditLogMaxSize, options.AuditLogMaxBackups)
+		if err != nil {
+			klog.Fatalf("could not open audit log: %s", err)
+		}
+		s.audit = audit
+		s.peers = &procPeerResolver{root: "/proc"}
+	}
+
+	resolver, err := newRoleResolver(options)
+	if err != nil {
+		klog.Fatalf("could not set up per-caller roles: %s", err)
 	}
+	s.roleResolver = resolver
 
-	if s.iamCreds != nil && s.iamRoleArn != "" {
-		config := s.getAWSConfig(s.iamCreds)
-		go s.credRefreshLoop(config)
+	if err := s.startCredentialSource(); err != nil {
+		klog.Fatalf("could not initialize IAM credentials: %s", err)
+	}
+	s.startIdentityCredentials()
+
+	if options.ContainerCredentialsListen != "" {
+		token, err := readContainerAuthToken(options.ContainerAuthTokenFile)
+		if err != nil {
+			klog.Fatalf("could not set up container credentials endpoint: %s", err)
+		}
+		go func() {
+			klog.Fatalln(http.ListenAndServe(
+				options.ContainerCredentialsListen, s.ContainerHandler(token)))
+		}()
+	}
+
+	if options.TaskMetadataListen != "" {
+		if options.ECSContainerDefinitionsFile == "" {
+			klog.Fatalf("-ecs-task-metadata-listen requires -ecs-container-definitions-file")
+		}
+		go func() {
+			klog.Fatalln(http.ListenAndServe(
+				options.TaskMetadataListen, s.TaskMetadataHandler()))
+		}()
+	}
+
+	if options.PodIdentityListen != "" {
+		kube, err := newKubeClient(options)
+		if err != nil {
+			klog.Fatalf("could not set up pod identity endpoint: %s", err)
+		}
+		agent, err := newPodIdentityAgent(s,
+			newKubeTokenReviewer(kube, options.PodIdentityAudience))
+		if err != nil {
+			klog.Fatalf("could not set up pod identity endpoint: %s", err)
+		}
+		go func() {
+			klog.Fatalln(http.ListenAndServe(
+				options.PodIdentityListen, agent.Handler()))
+		}()
+	}
+
+	if options.UnixSocket != "" {
+		gid := -1
+		if options.UnixSocketGroup != "" {
+			gid, err = lookupGroup(options.UnixSocketGroup)
+			if err != nil {
+				klog.Fatalf("could not look up -unix-socket-group: %s", err)
+			}
+		}
+		l, err := listenUnix(options.UnixSocket, options.UnixSocketMode, gid)
+		if err != nil {
+			klog.Fatalf("could not listen on %s: %s", options.UnixSocket, err)
+		}
+		go func() {
+			klog.Fatalln(http.Serve(l, s.Handler()))
+		}()
 	}
 
 	klog.Fatalln(http.ListenAndServe(
@@ -184,7 +309,12 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("/latest/meta-data/block-device-mapping/", s.blockDeviceMappingHandler)
 	mux.HandleFunc("/latest/meta-data/iam/info", s.iamInfoHandler)
 	mux.HandleFunc("/latest/meta-data/iam/security-credentials", s.iamSecurityCredentialsListHandler)
-	mux.HandleFunc("/latest/meta-data/iam/security-credentials/", s.iamSecurityCredentialsHandler)
+	mux.Handle("/latest/meta-data/iam/security-credentials/", s.auditCredentials(
+		imdsTokenHeader, http.HandlerFunc(s.iamSecurityCredentialsHandler)))
+	mux.HandleFunc("/latest/meta-data/identity-credentials/ec2/info", s.identityInfoHandler)
+	mux.HandleFunc("/latest/meta-data/identity-credentials/ec2/security-credentials", s.identityCredentialsListHandler)
+	mux.Handle("/latest/meta-data/identity-credentials/ec2/security-credentials/", s.auditCredentials(
+		imdsTokenHeader, http.HandlerFunc(s.identityCredentialsHandler)))
 	mux.HandleFunc("/latest/meta-data/placement/availability-zone", s.placementAvailabilityZoneHandler)
 	mux.HandleFunc("/latest/meta-data/tags/instance/", s.tagsInstanceHandler)
 	mux.HandleFunc("/latest/meta-data/tags/instance", s.tagsInstanceHandler)
@@ -192,25 +322,32 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("/latest/meta-data/services/domain", s.servicesDomainHandler)
 	mux.HandleFunc("/latest/meta-data/services/endpoints", s.servicesEndpointsHandler)
 	mux.HandleFunc("/latest/dynamic/instance-identity/document", s.instanceIdentityHandler)
+	if s.options.DebugOverrides {
+		mux.HandleFunc("/debug/overrides", s.overridesDebugHandler)
+	}
 
-	return s.logRequest(mux)
+	return s.logRequest(s.overlayHandler(s.pathMappingHandler(mux)))
 }
 
-func (s *Server) getAWSConfig(creds *credentials.Credentials) *aws.Config {
-	fields, err := s.getV1StandardMetadata()
-	if err != nil {
-		klog.Fatalf("cannot load metadata: %s", err)
-	}
-	region, err := getScalarFieldValue(fields, "region", "")
+// getAWSConfig returns the configuration for AWS clients using creds.  It
+// is called from request handlers, so it fails rather than exiting when
+// the instance data is unusable.
+func (s *Server) getAWSConfig(creds *credentials.Credentials) (*aws.Config, error) {
+	md, err := s.getMetadata("v1.region")
 	if err != nil {
-		klog.Fatalf("region not in metadata: %s", err)
+		return nil, fmt.Errorf("cannot load metadata: %w", err)
 	}
+	region := md.V1.Region
 
 	klog.Infof("AWS region: %s", region)
-	config := aws.NewConfig().WithRegion(region).WithCredentials(creds)
+	config, err := s.applyEndpointOptions(
+		aws.NewConfig().WithRegion(region).WithCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS endpoint options: %w", err)
+	}
 	endpointData, err := s.getEndpoints()
 	if err != nil {
-		klog.Fatalf("could not parse AWS endpoints in metadata: %s", err)
+		return nil, fmt.Errorf("could not parse AWS endpoints in metadata: %w", err)
 	}
 
 	if len(endpointData) != 0 {
@@ -230,61 +367,243 @@ func (s *Server) getAWSConfig(creds *credentials.Credentials) *aws.Config {
 			endpoints.ResolverFunc(endpointResolver))
 	}
 
-	return config
+	return config, nil
 }
 
-func (s *Server) credRefreshLoop(config *aws.Config) {
-	for {
+// credentialFetcher obtains a fresh set of credentials for the served role.
+type credentialFetcher func() (*credentials.Credentials, error)
+
+// startCredentialSource loads the initial IAM credentials and starts the
+// refresh loop for the configured credential source.
+func (s *Server) startCredentialSource() error {
+	switch s.options.CredentialSource {
+	case "", credentialSourceMetadata:
+		iamCreds, imdsCreds, roleArn, err := s.getIAMCredentials()
+		if err != nil {
+			return fmt.Errorf("could not fetch IAM credentials from metadata: %w", err)
+		}
+		s.iamMu.Lock()
+		s.iamCreds, s.imdsCreds, s.iamRoleArn = iamCreds, imdsCreds, roleArn
+		s.iamMu.Unlock()
+		if iamCreds != nil && roleArn != "" {
+			config, err := s.getAWSConfig(iamCreds)
+			if err != nil {
+				return err
+			}
+			go s.credRefreshLoop(s.assumeRoleFetcher(config))
+		} else if imdsCreds != nil {
+			s.syncCredentialFiles(imdsCreds)
+		}
+	case credentialSourceRolesAnywhere:
+		provider, err := s.newRolesAnywhereProvider()
+		if err != nil {
+			return err
+		}
+		s.iamMu.Lock()
+		s.iamRoleArn = s.options.RolesAnywhereRoleArn
+		s.iamMu.Unlock()
+		go s.credRefreshLoop(refreshingFetcher(credentials.NewCredentials(provider)))
+	case credentialSourceProcess:
+		if s.options.CredentialProcess == "" {
+			return errors.New("process credential source requires -credential-process")
+		}
+		if s.options.IAMRoleName == "" && s.options.IAMRoleArn == "" {
+			return errors.New("process credential source requires -iam-role-name or -iam-role-arn")
+		}
+		s.iamMu.Lock()
+		s.iamRoleArn = s.options.IAMRoleArn
+		s.iamMu.Unlock()
+		go s.credRefreshLoop(refreshingFetcher(
+			processcreds.NewCredentials(s.options.CredentialProcess)))
+	case credentialSourceVault:
+		provider, err := s.newVaultProvider()
+		if err != nil {
+			return err
+		}
+		if s.options.IAMRoleName == "" && s.options.IAMRoleArn == "" {
+			s.options.IAMRoleName = path.Base(provider.credsPath)
+		}
+		s.iamMu.Lock()
+		s.iamRoleArn = s.options.IAMRoleArn
+		s.iamMu.Unlock()
+		go s.credRefreshLoop(refreshingFetcher(credentials.NewCredentials(provider)))
+	case credentialSourceProfile:
+		src, err := s.newProfileCredentialSource()
+		if err != nil {
+			return err
+		}
+		creds, err := src.credentials(s.options.AWSProfile, 0)
+		if err != nil {
+			return err
+		}
+		roleArn, roleName := src.roleFor(s.options.AWSProfile)
+		if s.options.IAMRoleArn != "" {
+			roleArn = s.options.IAMRoleArn
+		}
+		if s.options.IAMRoleName == "" && roleArn == "" {
+			s.options.IAMRoleName = roleName
+		}
+		s.iamMu.Lock()
+		s.iamRoleArn = roleArn
+		s.iamMu.Unlock()
+		go s.credRefreshLoop(refreshingFetcher(creds))
+	case credentialSourceOffline:
+		roleArn := s.options.IAMRoleArn
+		if roleArn == "" {
+			if s.options.IAMRoleName == "" {
+				return errors.New("offline credential source requires -iam-role-name or -iam-role-arn")
+			}
+			roleArn = fmt.Sprintf("arn:aws:iam::%s:role/%s",
+				s.options.AccountID, s.options.IAMRoleName)
+		}
+		sts := newOfflineSTS(s.options.AccountID, s.options.OfflineCredentialTTL)
+		s.offlineSTS = sts
+		if s.options.OfflineSTSListen != "" {
+			go func() {
+				klog.Fatalln(http.ListenAndServe(
+					s.options.OfflineSTSListen, sts.Handler()))
+			}()
+		}
+		s.iamMu.Lock()
+		s.iamRoleArn = roleArn
+		s.iamMu.Unlock()
+		go s.credRefreshLoop(refreshingFetcher(credentials.NewCredentials(
+			&offlineProvider{sts: sts, roleArn: roleArn})))
+	default:
+		return fmt.Errorf(
+			"unknown credential source: %q", s.options.CredentialSource)
+	}
+	return nil
+}
+
+// assumeRoleFetcher returns a credentialFetcher that assumes the served role
+// through STS, using the most recently obtained credentials as the source.
+func (s *Server) assumeRoleFetcher(config *aws.Config) credentialFetcher {
+	return func() (*credentials.Credentials, error) {
 		sess, err := session.NewSession(config)
 		if err != nil {
-			klog.Fatalf("could not create AWS session: %v", err)
-			continue
+			return nil, fmt.Errorf("could not create AWS session: %w", err)
 		}
 
 		s.iamMu.RLock()
 		roleArn := s.iamRoleArn
 		s.iamMu.RUnlock()
 
-		credentials := stscreds.NewCredentials(sess, roleArn)
-		creds, err := credentials.Get()
-		if err != nil {
-			klog.Errorf("could not refresh credentials: %v", err)
-			continue
+		creds := stscreds.NewCredentials(sess, roleArn)
+		if _, err := creds.Get(); err != nil {
+			return nil, err
 		}
-		sess.Config.Credentials = credentials
+		config = config.WithCredentials(creds)
+		return creds, nil
+	}
+}
 
-		s.iamMu.Lock()
-		s.iamCreds = credentials
-		s.imdsCreds.AccessKeyID = creds.AccessKeyID
-		s.imdsCreds.SecretAccessKey = creds.SecretAccessKey
-		s.imdsCreds.Token = creds.SessionToken
-		expiresAt, err := s.iamCreds.ExpiresAt()
-		if err != nil {
-			s.iamMu.Unlock()
-			klog.Errorf("could not obtain credentials expiry: %v", err)
+// refreshingFetcher returns a credentialFetcher that forces creds to be
+// retrieved again from their provider on every call.
+func refreshingFetcher(creds *credentials.Credentials) credentialFetcher {
+	return func() (*credentials.Credentials, error) {
+		creds.Expire()
+		if _, err := creds.Get(); err != nil {
+			return nil, err
+		}
+		return creds, nil
+	}
+}
+
+func (s *Server) credRefreshLoop(fetch credentialFetcher) {
+	s.refreshLoop("credentials", fetch, s.publishCredentials)
+}
+
+// refreshLoop periodically obtains credentials with fetch and hands them
+// to publish.  what names the credentials in log messages.
+func (s *Server) refreshLoop(
+	what string,
+	fetch credentialFetcher,
+	publish func(*credentials.Credentials) error,
+) {
+	for {
+		credentials, err := fetch()
+		if err == nil {
+			err = publish(credentials)
+		}
+		if errors.Is(err, errNoIdentityCredentials) {
+			klog.V(2).Infof("no %s yet: %v", what, err)
+			time.Sleep(credRetryInterval)
+			continue
+		} else if err != nil {
+			klog.Errorf("could not refresh %s: %v", what, err)
+			time.Sleep(credRetryInterval)
 			continue
 		}
-		s.imdsCreds.Expiration = expiresAt.Format(time.RFC3339)
-		s.imdsCreds.LastUpdated = time.Now().UTC().Format(time.RFC3339)
-		s.iamMu.Unlock()
 
-		config = config.WithCredentials(credentials)
-		nextRefresh := getCredRefreshInterval(config)
+		nextRefresh := s.options.CredentialRefreshInterval
+		if nextRefresh <= 0 {
+			nextRefresh = getCredRefreshInterval(credentials)
+		}
 
 		if credentials.IsExpired() {
-			klog.Warning(
-				"credentials refreshed successfully, but are still expired")
+			klog.Warningf(
+				"%s refreshed successfully, but are still expired", what)
 		} else {
-			klog.Infof("credentials refreshed successfully, next refresh in %s",
-				nextRefresh.String())
+			klog.Infof("%s refreshed successfully, next refresh in %s",
+				what, nextRefresh.String())
 		}
 
 		time.Sleep(nextRefresh)
 	}
 }
 
-func getCredRefreshInterval(config *aws.Config) time.Duration {
-	expiresAt, err := config.Credentials.ExpiresAt()
+// publishCredentials makes creds the credentials served to clients.
+func (s *Server) publishCredentials(creds *credentials.Credentials) error {
+	imdsCreds, err := imdsCredentialsFrom(creds)
+	if err != nil {
+		return err
+	}
+
+	s.iamMu.Lock()
+	s.iamCreds = creds
+	s.imdsCreds = imdsCreds
+	s.iamMu.Unlock()
+
+	s.syncCredentialFiles(imdsCreds)
+	return nil
+}
+
+// imdsCredentialsFrom retrieves creds and converts them to the IMDS
+// security-credentials format.
+func imdsCredentialsFrom(creds *credentials.Credentials) (*IMDSCredentials, error) {
+	val, err := creds.Get()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := creds.ExpiresAt()
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "ProviderNotExpirer" {
+		// Static credentials, e.g. from a shared credentials file.
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not obtain credentials expiry: %w", err)
+	}
+	if expiresAt.IsZero() {
+		// Non-expiring credentials are re-fetched every
+		// minRefreshInterval, advertise a matching expiry.
+		expiresAt = time.Now().Add(2 * minRefreshInterval)
+	}
+
+	return &IMDSCredentials{
+		AccessKeyID:     val.AccessKeyID,
+		Code:            "Success",
+		Expiration:      expiresAt.UTC().Format(time.RFC3339),
+		LastUpdated:     time.Now().UTC().Format(time.RFC3339),
+		SecretAccessKey: val.SecretAccessKey,
+		Token:           val.SessionToken,
+		Type:            "AWS-HMAC",
+	}, nil
+}
+
+func getCredRefreshInterval(creds *credentials.Credentials) time.Duration {
+	expiresAt, err := creds.ExpiresAt()
 	if err != nil {
 		return minRefreshInterval
 	}
@@ -311,208 +630,43 @@ func (s *Server) logRequest(handler http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) getInstanceData() (map[string]interface{}, error) {
+func (s *Server) getInstanceData() (*instanceDataSnapshot, error) {
 	return s.dataSource.GetInstanceData()
 }
 
-func (s *Server) getV1StandardMetadata() (map[string]interface{}, error) {
-	idata, err := s.getInstanceData()
-	if err != nil {
-		return nil, err
-	}
-	fields, found := idata["v1"]
-	if !found {
-		klog.Errorf("v1 is missing or malformed\n")
-		return nil, errors.New("v1 metadata is missing or malformed")
-	}
-	return fields.(map[string]interface{}), nil
-}
-
-func (s *Server) getDSMetadata() (map[string]interface{}, error) {
-	idata, err := s.getInstanceData()
-	if err != nil {
-		return nil, err
-	}
-	ds, found := idata["ds"]
-	if !found {
-		klog.Errorf("ds metadata is missing or malformed\n")
-		return nil, errors.New("ds metadata is missing or malformed")
-	}
-	fields, found := ds.(map[string]interface{})["meta_data"]
-	if !found {
-		klog.Errorf("ds metadata is missing or malformed\n")
-		return nil, errors.New("ds metadata is missing or malformed")
-	}
-	return fields.(map[string]interface{}), nil
-}
-
-func getScalarFieldValue(
-	fields map[string]interface{},
-	name string,
-	deflt string,
-) (string, error) {
-	val, found := fields[name]
-	if !found {
-		name = strings.ReplaceAll(name, "-", "_")
-		val, found = fields[name]
-		if !found {
-			name = strings.ReplaceAll(name, "_", "-")
-			val, found = fields[name]
-			if !found {
-				if deflt != "" {
-					return deflt, nil
-				}
-				klog.Errorf("'%s' metadata value is missing\n", name)
-				return "", fmt.Errorf("%s is missing in metadata", name)
-			}
-		}
-	}
-
-	switch v := val.(type) {
-	case string:
-		return v, nil
-	default:
-		klog.Errorf("'%s' metadata value is not a string\n", name)
-		return "", fmt.Errorf("%s value is not a string", name)
-	}
-}
-
-func getMapFieldValue(
-	fields map[string]interface{},
-	name string,
-	deflt map[string]interface{},
-) (map[string]interface{}, error) {
-	val, found := fields[name]
-	if !found {
-		name = strings.ReplaceAll(name, "-", "_")
-		val, found = fields[name]
-		if !found {
-			name = strings.ReplaceAll(name, "_", "-")
-			val, found = fields[name]
-			if !found {
-				if deflt != nil {
-					return deflt, nil
-				}
-				klog.Errorf("'%s' metadata value is missing\n", name)
-				return nil, fmt.Errorf("%s is missing in metadata", name)
-			}
-		}
-	}
-
-	if val == nil {
-		return nil, nil
-	}
-
-	switch v := val.(type) {
-	case map[string]interface{}:
-		return v, nil
-	default:
-		klog.Errorf("'%s' metadata value is not a map\n", name)
-		return nil, fmt.Errorf("%s value is not a map", name)
-	}
-}
-
-func (s *Server) getV1FieldValue(
-	name string,
-	deflt string,
-) (string, error) {
-	fields, err := s.getV1StandardMetadata()
-	if err != nil {
-		return "", err
-	}
-	return getScalarFieldValue(fields, name, deflt)
-}
-
-func (s *Server) getDSFieldValue(
-	name string,
-	deflt string,
-) (string, error) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		return "", err
-	}
-	return getScalarFieldValue(fields, name, deflt)
-}
-
-func (s *Server) formatV1Fields(
-	format string,
-	names ...string,
-) (string, error) {
-	fields, err := s.getV1StandardMetadata()
-	if err != nil {
-		return "", err
-	}
-
-	return formatFields(format, fields, names...)
-}
-
-func (s *Server) formatDSFields(
-	format string,
-	names ...string,
-) (string, error) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		return "", err
-	}
-
-	return formatFields(format, fields, names...)
-}
-
-func formatFields(
-	format string,
-	fields map[string]interface{},
-	names ...string,
-) (string, error) {
-	vals := make([]interface{}, len(names))
-
-	for i, name := range names {
-		val, err := getScalarFieldValue(fields, name, "")
-		if err != nil {
-			return "", err
-		}
-		vals[i] = val
-	}
-
-	return fmt.Sprintf(format, vals...), nil
-}
-
 func (s *Server) getIAMCredentials() (*credentials.Credentials, *IMDSCredentials, string, error) {
-	fields, err := s.getDSMetadata()
+	md, err := s.getMetadata("ds.meta_data.iam")
 	if err != nil {
 		return nil, nil, "", err
 	}
-	iam, err := getMapFieldValue(fields, "iam", make(map[string]interface{}))
-	if err != nil {
-		return nil, nil, "", err
-	}
-	if len(iam) == 0 {
+	iam := md.DS.IAM
+	if iam == nil || iam.Credentials == nil {
 		return nil, nil, "", nil
 	}
-	role, _ := getScalarFieldValue(iam, "role-arn", "")
-	creds, err := getMapFieldValue(
-		iam, "credentials", make(map[string]interface{}))
-	if err != nil {
-		return nil, nil, "", err
+	creds := iam.Credentials
+	if creds.Expiration == "" {
+		return nil, nil, "", &fieldError{
+			path: "ds.meta_data.iam.credentials.Expiration",
+			msg:  "is missing in metadata",
+		}
 	}
-	if len(creds) == 0 {
-		return nil, nil, "", nil
+	lastUpdated := creds.LastUpdated
+	if lastUpdated == "" {
+		lastUpdated = time.Now().UTC().Format(time.RFC3339)
 	}
 	klog.Info("loaded IAM credentials from metadata")
 	iamCreds := credentials.NewStaticCredentials(
-		creds["AccessKeyId"].(string),
-		creds["SecretAccessKey"].(string),
-		creds["Token"].(string),
-	)
+		creds.AccessKeyID, creds.SecretAccessKey, creds.Token)
 	imdsCreds := &IMDSCredentials{
-		AccessKeyID:     creds["AccessKeyId"].(string),
-		SecretAccessKey: creds["SecretAccessKey"].(string),
-		Token:           creds["Token"].(string),
-		Code:            creds["Code"].(string),
-		Expiration:      creds["Expiration"].(string),
-		LastUpdated:     creds["LastUpdated"].(string),
-		Type:            creds["Type"].(string),
-	}
-	return iamCreds, imdsCreds, role, nil
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		Token:           creds.Token,
+		Code:            creds.Code,
+		Expiration:      creds.Expiration,
+		LastUpdated:     lastUpdated,
+		Type:            creds.Type,
+	}
+	return iamCreds, imdsCreds, iam.RoleArn, nil
 }
 
 // getIMDSCredentials returns a snapshot of the current IMDS credentials.
@@ -541,26 +695,27 @@ func (s *Server) tokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", ttl)
-	token := base64.URLEncoding.EncodeToString([]byte("dummytoken"))
-	fmt.Fprintf(w, "%s", token)
+	// Tokens are not checked, but each session gets its own, so that the
+	// audit log can tell sessions apart.
+	fmt.Fprintf(w, "%s", randomString(32, base64.URLEncoding.EncodeToString))
 }
 
 func (s *Server) amiIDHandler(w http.ResponseWriter, _ *http.Request) {
-	val, err := s.formatV1Fields("%s-%s", "distro", "distro_release")
+	md, err := s.getMetadata("v1.distro", "v1.distro_release")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s", val)
+	fmt.Fprintf(w, "%s-%s", md.V1.Distro, md.V1.DistroRelease)
 }
 
 func (s *Server) localHostnameHandler(w http.ResponseWriter, _ *http.Request) {
-	val, err := s.formatDSFields("%s", "local_hostname")
+	md, err := s.getMetadata("ds.meta_data.local_hostname")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s", val)
+	fmt.Fprintf(w, "%s", md.DS.LocalHostname)
 }
 
 func (s *Server) getLocalIPv4Address(iface string) (string, error) {
@@ -606,21 +761,21 @@ func (s *Server) localIPv4Handler(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (s *Server) instanceIDHandler(w http.ResponseWriter, r *http.Request) {
-	val, err := s.formatV1Fields("%s", "instance_id")
+	md, err := s.getMetadata("v1.instance_id")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s", val)
+	fmt.Fprintf(w, "%s", md.V1.InstanceID)
 }
 
 func (s *Server) instanceTypeHandler(w http.ResponseWriter, r *http.Request) {
-	instType, err := s.getDSFieldValue("instance_type", "t2.micro")
+	md, err := s.getMetadata("ds.meta_data.instance_type")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s", instType)
+	fmt.Fprintf(w, "%s", md.DS.InstanceType)
 }
 
 // iamInfoResponse matches the JSON structure returned by real AWS IMDS at
@@ -633,40 +788,21 @@ type iamInfoResponse struct {
 }
 
 func (s *Server) iamInfoHandler(w http.ResponseWriter, r *http.Request) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	iam, err := getMapFieldValue(fields, "iam", make(map[string]interface{}))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if len(iam) == 0 {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
-	}
-	profile, err := getMapFieldValue(
-		iam, "instance-profile", make(map[string]interface{}))
+	md, err := s.getMetadata("ds.meta_data.iam.instance-profile")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if len(profile) == 0 {
+	if md.DS.IAM == nil || md.DS.IAM.InstanceProfile == nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	arn, _ := getScalarFieldValue(profile, "arn", "")
-	id, _ := getScalarFieldValue(profile, "id", "")
-
 	info := iamInfoResponse{
 		Code:               "Success",
 		LastUpdated:        time.Now().UTC().Format(time.RFC3339),
-		InstanceProfileArn: arn,
-		InstanceProfileID:  id,
+		InstanceProfileArn: md.DS.IAM.InstanceProfile.Arn,
+		InstanceProfileID:  md.DS.IAM.InstanceProfile.ID,
 	}
 
 	data, err := json.MarshalIndent(info, "", "  ")
@@ -677,70 +813,78 @@ func (s *Server) iamInfoHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", data)
 }
 
-func (s *Server) iamSecurityCredentialsListHandler(w http.ResponseWriter, r *http.Request) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// getRoleName returns the name of the served role.  For the metadata
+// credential source it comes from ds.meta_data.iam.role-name, for other
+// sources it is either set explicitly or derived from the configured role
+// ARN.  An empty name means no role is available.
+func (s *Server) getRoleName() (string, error) {
+	switch s.options.CredentialSource {
+	case "", credentialSourceMetadata:
+	default:
+		if s.options.IAMRoleName != "" {
+			return s.options.IAMRoleName, nil
+		}
+		s.iamMu.RLock()
+		roleArn := s.iamRoleArn
+		s.iamMu.RUnlock()
+		return roleNameFromArn(roleArn), nil
 	}
 
-	iam, err := getMapFieldValue(fields, "iam", make(map[string]interface{}))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	md, err := s.getMetadata("ds.meta_data.iam.role-name")
+	if err != nil || md.DS.IAM == nil {
+		return "", err
 	}
-	if len(iam) == 0 {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
+	return md.DS.IAM.RoleName, nil
+}
+
+// roleNameFromArn returns the role name component of an IAM role ARN
+// (the last element of its path).
+func roleNameFromArn(roleArn string) string {
+	if roleArn == "" {
+		return ""
 	}
-	roleName, err := getScalarFieldValue(iam, "role-name", "")
+	return path.Base(roleArn[strings.LastIndex(roleArn, ":")+1:])
+}
+
+func (s *Server) iamSecurityCredentialsListHandler(w http.ResponseWriter, r *http.Request) {
+	role, err := s.resolveRole(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if roleName == "" {
+	if role == nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	fmt.Fprintf(w, "%s", roleName)
+	fmt.Fprintf(w, "%s", role.name)
 }
 
 func (s *Server) iamSecurityCredentialsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/latest/meta-data/iam/security-credentials/" {
+		auditRecordFrom(r).skip()
 		s.iamSecurityCredentialsListHandler(w, r)
 		return
 	}
 
-	fields, err := s.getDSMetadata()
+	roleInURL := path.Base(r.URL.Path)
+	role, err := s.resolveRole(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditRecordFrom(r).setRole(role)
 
-	iam, err := getMapFieldValue(fields, "iam", make(map[string]interface{}))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if len(iam) == 0 {
+	if role == nil || strings.Compare(roleInURL, role.name) != 0 {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	roleInURL := path.Base(r.URL.Path)
-	roleInMetadata, err := getScalarFieldValue(iam, "role-name", "")
+	imdsCreds, err := s.getRoleCredentials(role)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	if strings.Compare(roleInURL, roleInMetadata) != 0 {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
-	}
-
-	iamCreds, imdsCreds := s.getIMDSCredentials()
-	if iamCreds == nil {
+	if imdsCreds == nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
@@ -749,6 +893,7 @@ func (s *Server) iamSecurityCredentialsHandler(w http.ResponseWriter, r *http.Re
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditRecordFrom(r).setAccessKeyID(imdsCreds.AccessKeyID)
 	fmt.Fprintf(w, "%s", data)
 }
 
@@ -819,88 +964,37 @@ func (s *Server) blockDeviceMappingHandler(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) placementAvailabilityZoneHandler(w http.ResponseWriter, r *http.Request) {
-	az, err := s.getV1FieldValue("availability_zone", "")
+	md, err := s.getMetadata("v1.availability_zone")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s", az)
+	fmt.Fprintf(w, "%s", md.V1.AvailabilityZone)
 }
 
 func (s *Server) servicesDomainHandler(w http.ResponseWriter, r *http.Request) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	services, err := getMapFieldValue(fields, "services", nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if services == nil {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
-	}
-
-	dom, err := getScalarFieldValue(services, "domain", "")
+	md, err := s.getMetadata("ds.meta_data.services.domain")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if dom == "" {
+	if md.DS.Services == nil || md.DS.Services.Domain == "" {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	fmt.Fprintf(w, "%s", dom)
+	fmt.Fprintf(w, "%s", md.DS.Services.Domain)
 }
 
 func (s *Server) getEndpoints() (map[string]string, error) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		return nil, err
-	}
-
-	services, err := getMapFieldValue(fields, "services", nil)
-	if err != nil {
-		return nil, err
-	}
-	if services == nil {
-		return nil, nil
-	}
-
-	endpoints, err := getMapFieldValue(services, "endpoints", nil)
-	if err != nil {
+	md, err := s.getMetadata("ds.meta_data.services.endpoints")
+	if err != nil || md.DS.Services == nil {
 		return nil, err
 	}
-
-	result := make(map[string]string, len(endpoints))
-	for k, v := range endpoints {
-		result[k] = v.(string)
-	}
-
-	return result, nil
+	return md.DS.Services.Endpoints, nil
 }
 
 func (s *Server) servicesEndpointsHandler(w http.ResponseWriter, r *http.Request) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	services, err := getMapFieldValue(fields, "services", nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if services == nil {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
-	}
-
-	endpoints, err := getMapFieldValue(services, "endpoints", nil)
+	endpoints, err := s.getEndpoints()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -948,49 +1042,15 @@ func (s *Server) instanceIdentityHandler(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	fields, err := s.getV1StandardMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	dsfields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	az, err := getScalarFieldValue(fields, "availability_zone", "")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	instID, err := getScalarFieldValue(fields, "instance_id", "")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	instType, err := getScalarFieldValue(dsfields, "instance_type", "t2.micro")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	imageID, err := s.formatV1Fields("%s %s", "distro", "distro_release")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	machine, err := getScalarFieldValue(fields, "machine", "")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	region, err := getScalarFieldValue(fields, "region", "")
+	md, err := s.getMetadata(
+		"v1.availability_zone",
+		"v1.instance_id",
+		"ds.meta_data.instance_type",
+		"v1.distro",
+		"v1.distro_release",
+		"v1.machine",
+		"v1.region",
+	)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1005,19 +1065,19 @@ func (s *Server) instanceIdentityHandler(
 	doc := instanceIdentityDocument{
 		DevpayProductCodes:      nil,
 		MarketplaceProductCodes: nil,
-		AvailabilityZone:        az,
+		AvailabilityZone:        md.V1.AvailabilityZone,
 		PrivateIP:               ipString,
 		Version:                 "2017-09-30",
-		InstanceID:              instID,
+		InstanceID:              md.V1.InstanceID,
 		BillingProducts:         nil,
-		InstanceType:            instType,
+		InstanceType:            md.DS.InstanceType,
 		AccountID:               s.options.AccountID,
-		ImageID:                 imageID,
+		ImageID:                 md.V1.Distro + " " + md.V1.DistroRelease,
 		PendingTime:             s.startTime.Format(time.RFC3339),
-		Architecture:            machine,
+		Architecture:            md.V1.Machine,
 		KernelID:                nil,
 		RamdiskID:               nil,
-		Region:                  region,
+		Region:                  md.V1.Region,
 	}
 
 	jsonData, err := json.Marshal(doc)
@@ -1030,17 +1090,12 @@ func (s *Server) instanceIdentityHandler(
 }
 
 func (s *Server) tagsInstanceHandler(w http.ResponseWriter, r *http.Request) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	tags, err := getMapFieldValue(fields, "tags", make(map[string]interface{}))
+	md, err := s.getMetadata("ds.meta_data.tags")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	tags := md.DS.Tags
 	if len(tags) == 0 {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -1052,14 +1107,7 @@ func (s *Server) tagsInstanceHandler(w http.ResponseWriter, r *http.Request) {
 
 	if reqPath == prefix {
 		// List all tag keys
-		i := 0
-		for key := range tags {
-			if i > 0 {
-				fmt.Fprintf(w, "\n")
-			}
-			fmt.Fprintf(w, "%s", key)
-			i++
-		}
+		fmt.Fprintf(w, "%s", strings.Join(sortedKeys(tags), "\n"))
 		return
 	}
 
@@ -1076,32 +1124,14 @@ func (s *Server) tagsInstanceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Fprintf(w, "%s", val.(string))
+	fmt.Fprintf(w, "%s", val)
 }
 
 func (s *Server) autoscalingLifecycleStateHandler(w http.ResponseWriter, r *http.Request) {
-	fields, err := s.getDSMetadata()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	autoscaling, err := getMapFieldValue(
-		fields, "autoscaling", make(map[string]interface{}))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if len(autoscaling) == 0 {
-		fmt.Fprintf(w, "InService")
-		return
-	}
-
-	state, err := getScalarFieldValue(
-		autoscaling, "target_lifecycle_state", "InService")
+	md, err := s.getMetadata("ds.meta_data.autoscaling")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s", state)
+	fmt.Fprintf(w, "%s", md.DS.Autoscaling.TargetLifecycleState)
 }
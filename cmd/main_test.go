@@ -5,20 +5,45 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
 )
 
-// mockInstanceData implements InstanceDataSource backed by an in-memory map.
+// writeTestFile writes data to name under root, creating its parent
+// directories.
+func writeTestFile(t *testing.T, root, name, data string) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mockInstanceData serves data as a single snapshot, taken on first use;
+// tests changing data afterwards must reset snap.
 type mockInstanceData struct {
 	data map[string]interface{}
+	err  error
+	snap *instanceDataSnapshot
 }
 
-func (m *mockInstanceData) GetInstanceData() (map[string]interface{}, error) {
-	return m.data, nil
+func (m *mockInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.snap == nil {
+		m.snap = newInstanceDataSnapshot(m.data)
+	}
+	return m.snap, nil
 }
 
 // mockNetworkInfo provides a deterministic NetworkInfo for tests.
@@ -80,13 +105,15 @@ func defaultMockNetworkInfo() *mockNetworkInfo {
 
 func newTestServer(t *testing.T, data map[string]interface{}) *Server {
 	t.Helper()
-	return &Server{
+	s := &Server{
 		dataSource:   &mockInstanceData{data: data},
 		startTime:    time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
 		options:      &Options{NetIface: "eth0", AccountID: "123456789012"},
 		networkInfo:  defaultMockNetworkInfo(),
 		blockDevices: &mockBlockDeviceSource{devices: map[string]string{}},
 	}
+	s.roleCache = newRoleCredentialCache(s)
+	return s
 }
 
 func newTestServerWithIAM(t *testing.T, data map[string]interface{}) *Server {
@@ -223,6 +250,24 @@ func TestTokenHandlerReturnsTTLHeader(t *testing.T) {
 	}
 }
 
+func TestTokenHandlerMintsTokens(t *testing.T) {
+	s := newTestServer(t, baseTestData())
+	tokens := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("PUT", "/latest/api/token", nil)
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+		w := httptest.NewRecorder()
+		s.tokenHandler(w, req)
+		if w.Body.Len() == 0 {
+			t.Fatal("expected a token")
+		}
+		tokens[w.Body.String()] = true
+	}
+	if len(tokens) != 2 {
+		t.Errorf("expected a new token per session, got %v", tokens)
+	}
+}
+
 // --- Middleware edge cases ---
 
 func TestMiddlewareServerHeader(t *testing.T) {
@@ -765,3 +810,54 @@ func TestGetEndpointsNoServices(t *testing.T) {
 		t.Errorf("expected nil, got %v", eps)
 	}
 }
+
+// --- credential_process source ---
+
+func TestProcessCredentialSource(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "creds.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo '{"Version": 1, "AccessKeyId": "ASIAPROC", "SecretAccessKey": "procsecret",
+  "SessionToken": "proctoken", "Expiration": "2099-01-01T00:00:00Z"}'
+`), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, baseTestData())
+	s.options.CredentialSource = credentialSourceProcess
+	s.options.IAMRoleName = "proc-role"
+
+	creds, err := refreshingFetcher(processcreds.NewCredentials(script))()
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if err := s.publishCredentials(creds); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/proc-role", nil)
+	w := httptest.NewRecorder()
+	s.iamSecurityCredentialsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var got IMDSCredentials
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if got.AccessKeyID != "ASIAPROC" || got.Token != "proctoken" ||
+		got.Expiration != "2099-01-01T00:00:00Z" || got.Code != "Success" {
+		t.Errorf("unexpected credentials: %+v", got)
+	}
+}
+
+func TestProcessCredentialSourceRequiresRole(t *testing.T) {
+	s := newTestServer(t, baseTestData())
+	s.options.CredentialSource = credentialSourceProcess
+	s.options.CredentialProcess = "/bin/true"
+
+	if err := s.startCredentialSource(); err == nil {
+		t.Error("expected error without a role name or ARN")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+	"gopkg.in/yaml.v3"
+)
+
+// pathMapping serves IMDS paths defined in a mapping file rather than in
+// Go, each by a JMESPath expression over the instance data:
+//
+//	paths:
+//	  meta-data/instance-type:
+//	    expression: ds.meta_data.flavor.name
+//	    default: t2.micro
+//	  meta-data/ami-id:
+//	    expression: "[v1.distro, v1.distro_release]"
+//	    format: ami-%s-%s
+//
+// Paths are relative to /latest/.  Mapped paths take precedence over the
+// built-in handlers.
+type pathMapping struct {
+	paths map[string]*mappedPath
+}
+
+// mappedPath is a path in the mapping file.  If the expression yields
+// null, Default is served, or 404 if there is none.  Otherwise Format, if
+// set, is applied with the elements of an array result, or the result
+// itself, as its arguments; numbers without a fraction are passed as
+// integers so that %d works.  Without Format, strings, numbers and
+// booleans are served as is, arrays of them one per line (like IMDS
+// listings) and anything else as JSON.
+type mappedPath struct {
+	Expression string  `yaml:"expression"`
+	Format     string  `yaml:"format"`
+	Default    *string `yaml:"default"`
+
+	compiled *jmespath.JMESPath
+}
+
+type pathMappingFile struct {
+	Paths map[string]*mappedPath `yaml:"paths"`
+}
+
+// loadPathMapping reads and compiles the mapping file at path, which may
+// be YAML or JSON.
+func loadPathMapping(path string) (*pathMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file pathMappingFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	m := &pathMapping{paths: make(map[string]*mappedPath, len(file.Paths))}
+	for name, p := range file.Paths {
+		if p == nil || p.Expression == "" {
+			return nil, fmt.Errorf("%s: %s: missing expression", path, name)
+		}
+		compiled, err := jmespath.Compile(p.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+		p.compiled = compiled
+		m.paths[mappedURLPath(name)] = p
+	}
+	return m, nil
+}
+
+// mappedURLPath returns the URL path served for a mapping file path.
+func mappedURLPath(name string) string {
+	name = strings.TrimSuffix(name, "/")
+	if strings.HasPrefix(name, "/") {
+		return name
+	}
+	return "/latest/" + name
+}
+
+// pathMappingHandler serves the mapped paths and passes any other request
+// on to next.
+func (s *Server) pathMappingHandler(next http.Handler) http.Handler {
+	if s.pathMapping == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := s.pathMapping.paths[strings.TrimSuffix(r.URL.Path, "/")]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		snap, err := s.getInstanceData()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		value, found, err := p.evaluate(snap.data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "%s", value)
+	})
+}
+
+// evaluate returns the value of p in data, or false if it is null and
+// there is no default.
+func (p *mappedPath) evaluate(data map[string]interface{}) (string, bool, error) {
+	result, err := p.compiled.Search(data)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", p.Expression, err)
+	}
+	if result == nil {
+		if p.Default == nil {
+			return "", false, nil
+		}
+		return *p.Default, true, nil
+	}
+
+	if p.Format != "" {
+		var args []interface{}
+		if list, ok := result.([]interface{}); ok {
+			for _, v := range list {
+				args = append(args, formatArg(v))
+			}
+		} else {
+			args = []interface{}{formatArg(result)}
+		}
+		return fmt.Sprintf(p.Format, args...), true, nil
+	}
+
+	if list, ok := result.([]interface{}); ok {
+		lines := make([]string, 0, len(list))
+		for _, v := range list {
+			line, ok := scalarString(v)
+			if !ok {
+				return marshalMappedValue(result)
+			}
+			lines = append(lines, line)
+		}
+		return strings.Join(lines, "\n"), true, nil
+	}
+	if value, ok := scalarString(result); ok {
+		return value, true, nil
+	}
+	return marshalMappedValue(result)
+}
+
+func marshalMappedValue(v interface{}) (string, bool, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// formatArg passes whole numbers to fmt as integers.
+func formatArg(v interface{}) interface{} {
+	if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+	return v
+}
+
+// scalarString renders strings, numbers and booleans.
+func scalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
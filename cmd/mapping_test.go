@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPathMapping = `
+paths:
+  meta-data/ami-id:
+    expression: "[v1.distro, v1.distro_release]"
+    format: ami-%s-%s
+  meta-data/instance-type:
+    expression: ds.meta_data.flavor
+    default: t3.small
+  meta-data/placement/group-name:
+    expression: ds.meta_data.placement_group
+  meta-data/placement/partition-number:
+    expression: ds.meta_data.partition
+    format: "%d"
+  meta-data/tags/instance:
+    expression: keys(ds.meta_data.tags)
+  meta-data/iam/info:
+    expression: "{InstanceProfileArn: ds.meta_data.iam.\"instance-profile\".arn}"
+`
+
+func newTestMappingServer(t *testing.T, data map[string]interface{}, mapping string) *Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(path, []byte(mapping), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadPathMapping(path)
+	if err != nil {
+		t.Fatalf("loadPathMapping: %v", err)
+	}
+	s := newTestServer(t, data)
+	s.pathMapping = m
+	return s
+}
+
+func TestPathMapping(t *testing.T) {
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["partition"] = 3.0
+	md["tags"] = map[string]interface{}{"Name": "test-instance"}
+	s := newTestMappingServer(t, data, testPathMapping)
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/latest/meta-data/ami-id", http.StatusOK, "ami-debian-bookworm"},
+		{"/latest/meta-data/instance-type", http.StatusOK, "t3.small"},
+		{"/latest/meta-data/placement/group-name", http.StatusNotFound, "not found\n"},
+		{"/latest/meta-data/placement/partition-number", http.StatusOK, "3"},
+		{"/latest/meta-data/tags/instance", http.StatusOK, "Name"},
+		{"/latest/meta-data/iam/info", http.StatusOK,
+			"{\n  \"InstanceProfileArn\": \"arn:aws:iam::123456789012:instance-profile/test-profile\"\n}"},
+		// Paths without a mapping are served by the built-in handlers.
+		{"/latest/meta-data/instance-id", http.StatusOK, "i-test-1234"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || w.Body.String() != tt.body {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.path, tt.code, tt.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPathMappingErrors(t *testing.T) {
+	for _, mapping := range []string{
+		"paths:\n  meta-data/x:\n    format: \"%s\"\n",
+		"paths:\n  meta-data/x:\n    expression: \"foo[\"\n",
+		"paths: [",
+	} {
+		path := filepath.Join(t.TempDir(), "mapping.yaml")
+		if err := os.WriteFile(path, []byte(mapping), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPathMapping(path); err == nil {
+			t.Errorf("expected error for %q", mapping)
+		}
+	}
+}
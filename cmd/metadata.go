@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// instanceData is the typed view of the cloud-init instance data fields
+// used by the emulator: the standardized v1 keys and the datasource
+// metadata, normalized to the ds.meta_data layout by a dsAdapter.
+//
+// Decoding never fails as a whole.  Fields that are missing (if required)
+// or have the wrong type are recorded as fieldErrors and left at their
+// zero value, so that a bad tag only breaks the tags endpoint.  Callers
+// name the fields they depend on in check.
+type instanceData struct {
+	V1 v1Metadata
+	DS dsMetadata
+
+	errs []*fieldError
+}
+
+type v1Metadata struct {
+	InstanceID       string
+	Region           string
+	AvailabilityZone string
+	Machine          string
+	Distro           string
+	DistroRelease    string
+	Platform         string
+	CloudName        string
+}
+
+type dsMetadata struct {
+	LocalHostname       string
+	InstanceType        string
+	Tags                map[string]string
+	Autoscaling         autoscalingMetadata
+	IAM                 *iamMetadata
+	IdentityCredentials *metadataCredentials
+	Services            *servicesMetadata
+	Vault               *vaultMetadata
+}
+
+type autoscalingMetadata struct {
+	TargetLifecycleState string
+}
+
+type iamMetadata struct {
+	RoleName        string
+	RoleArn         string
+	InstanceProfile *instanceProfile
+	Credentials     *metadataCredentials
+}
+
+type instanceProfile struct {
+	Arn string
+	ID  string
+}
+
+// metadataCredentials are credentials provisioned in the instance data,
+// in the IMDS security-credentials format.
+type metadataCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+	Code            string
+	Expiration      string
+	LastUpdated     string
+	Type            string
+}
+
+type servicesMetadata struct {
+	Domain    string
+	Endpoints map[string]string
+}
+
+type vaultMetadata struct {
+	Addr    string
+	AppRole struct {
+		RoleID   string
+		SecretID string
+	}
+}
+
+// fieldError reports an instance-data field that is missing or malformed,
+// by its dotted path in the instance data document.
+type fieldError struct {
+	path string
+	msg  string
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s %s", e.path, e.msg)
+}
+
+// check returns the error recorded for any of paths, for a field nested
+// under one of them, or for an object containing one of them.
+func (d *instanceData) check(paths ...string) error {
+	for _, p := range paths {
+		for _, e := range d.errs {
+			if e.path == p ||
+				strings.HasPrefix(p, e.path+".") ||
+				strings.HasPrefix(e.path, p+".") {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// decodedInstanceData is the decoded form of the instance data snapshot
+// with the given version.
+type decodedInstanceData struct {
+	version uint64
+	data    *instanceData
+}
+
+// getMetadata returns the typed instance data after checking that the
+// fields at paths are present and well-formed.  The data is decoded once
+// per snapshot returned by the InstanceDataSource.
+func (s *Server) getMetadata(paths ...string) (*instanceData, error) {
+	snap, err := s.getInstanceData()
+	if err != nil {
+		return nil, err
+	}
+
+	cached := s.metadataCache.Load()
+	if cached == nil || cached.version != snap.version {
+		cached = &decodedInstanceData{version: snap.version, data: decodeInstanceData(snap.data)}
+		for _, e := range cached.data.errs {
+			klog.Warningf("instance data: %s", e)
+		}
+		s.metadataCache.Store(cached)
+	}
+
+	if err := cached.data.check(paths...); err != nil {
+		klog.Errorf("%s\n", err)
+		return nil, err
+	}
+	return cached.data, nil
+}
+
+// metadataDecoder walks the raw instance data, recording field errors.
+type metadataDecoder struct {
+	errs []*fieldError
+}
+
+func (d *metadataDecoder) fail(path, msg string) {
+	d.errs = append(d.errs, &fieldError{path: path, msg: msg})
+}
+
+// lookupField returns the value of name in fields.  Datasources spell
+// keys with dashes or underscores, so both are tried.
+func lookupField(fields map[string]interface{}, name string) (interface{}, bool) {
+	for _, key := range []string{
+		name,
+		strings.ReplaceAll(name, "-", "_"),
+		strings.ReplaceAll(name, "_", "-"),
+	} {
+		if val, found := fields[key]; found {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// object returns the object at name, or nil if it is missing, null or
+// malformed.
+func (d *metadataDecoder) object(
+	fields map[string]interface{},
+	parent, name string,
+	required bool,
+) map[string]interface{} {
+	path := joinFieldPath(parent, name)
+	val, found := lookupField(fields, name)
+	if !found || val == nil {
+		if required {
+			d.fail(path, "is missing in metadata")
+		}
+		return nil
+	}
+	if val == redactedPlaceholder {
+		d.fail(path, "is "+redactedPlaceholder)
+		return nil
+	}
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		d.fail(path, "value is not a map")
+		return nil
+	}
+	return obj
+}
+
+// present records an error if name is absent from fields.
+func (d *metadataDecoder) present(fields map[string]interface{}, parent, name string) {
+	if _, found := lookupField(fields, name); !found {
+		d.fail(joinFieldPath(parent, name), "is missing in metadata")
+	}
+}
+
+// str returns the string at name, or deflt if it is missing.
+func (d *metadataDecoder) str(
+	fields map[string]interface{},
+	parent, name string,
+	deflt string,
+	required bool,
+) string {
+	path := joinFieldPath(parent, name)
+	val, found := lookupField(fields, name)
+	if !found {
+		if required && deflt == "" {
+			d.fail(path, "is missing in metadata")
+		}
+		return deflt
+	}
+	s, ok := val.(string)
+	if !ok {
+		d.fail(path, "value is not a string")
+		return deflt
+	}
+	if s == redactedPlaceholder {
+		d.fail(path, "is "+redactedPlaceholder)
+		return deflt
+	}
+	return s
+}
+
+// strMap returns the object at name as a map of strings.  Entries that
+// are not strings are recorded as errors and left out.
+func (d *metadataDecoder) strMap(
+	fields map[string]interface{},
+	parent, name string,
+) map[string]string {
+	obj := d.object(fields, parent, name, false)
+	if obj == nil {
+		return nil
+	}
+	result := make(map[string]string, len(obj))
+	for k, v := range obj {
+		s, ok := v.(string)
+		if !ok {
+			d.fail(joinFieldPath(joinFieldPath(parent, name), k), "value is not a string")
+			continue
+		}
+		if s == redactedPlaceholder {
+			d.fail(joinFieldPath(joinFieldPath(parent, name), k), "is "+redactedPlaceholder)
+			continue
+		}
+		result[k] = s
+	}
+	return result
+}
+
+func joinFieldPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func decodeInstanceData(raw map[string]interface{}) *instanceData {
+	d := &metadataDecoder{}
+	data := &instanceData{}
+
+	if v1 := d.object(raw, "", "v1", true); v1 != nil {
+		data.V1 = d.decodeV1(v1, "v1")
+	}
+	if ds := d.object(raw, "", "ds", true); ds != nil {
+		if md := dsAdapterFor(data.V1)(d, ds); md != nil {
+			data.DS = d.decodeDS(md, dsMetaDataPath)
+		}
+	}
+
+	data.errs = d.errs
+	return data
+}
+
+func (d *metadataDecoder) decodeV1(fields map[string]interface{}, path string) v1Metadata {
+	az := d.str(fields, path, "availability_zone", "", true)
+	return v1Metadata{
+		InstanceID:       d.str(fields, path, "instance_id", "", true),
+		Region:           d.str(fields, path, "region", regionFromAZ(az), true),
+		AvailabilityZone: az,
+		Machine:          d.str(fields, path, "machine", "", true),
+		Distro:           d.str(fields, path, "distro", "", true),
+		DistroRelease:    d.str(fields, path, "distro_release", "", true),
+		Platform:         d.str(fields, path, "platform", "", false),
+		CloudName:        d.str(fields, path, "cloud_name", "", false),
+	}
+}
+
+func (d *metadataDecoder) decodeDS(fields map[string]interface{}, path string) dsMetadata {
+	md := dsMetadata{
+		LocalHostname: d.str(fields, path, "local_hostname", "", true),
+		InstanceType:  d.str(fields, path, "instance_type", "t2.micro", false),
+		Tags:          d.strMap(fields, path, "tags"),
+	}
+
+	md.Autoscaling.TargetLifecycleState = "InService"
+	if as := d.object(fields, path, "autoscaling", false); as != nil {
+		md.Autoscaling.TargetLifecycleState = d.str(
+			as, joinFieldPath(path, "autoscaling"), "target_lifecycle_state", "InService", false)
+	}
+
+	if iam := d.object(fields, path, "iam", false); len(iam) != 0 {
+		md.IAM = d.decodeIAM(iam, joinFieldPath(path, "iam"))
+	}
+	if creds := d.object(fields, path, "identity_credentials", false); len(creds) != 0 {
+		md.IdentityCredentials = d.decodeCredentials(
+			creds, joinFieldPath(path, "identity_credentials"))
+	}
+
+	// services and services.endpoints may be null, meaning that there
+	// are none, but not absent.
+	d.present(fields, path, "services")
+	if services := d.object(fields, path, "services", false); services != nil {
+		servicesPath := joinFieldPath(path, "services")
+		d.present(services, servicesPath, "endpoints")
+		md.Services = &servicesMetadata{
+			Domain:    d.str(services, servicesPath, "domain", "", false),
+			Endpoints: d.strMap(services, servicesPath, "endpoints"),
+		}
+	}
+
+	if vault := d.object(fields, path, "vault", false); vault != nil {
+		vaultPath := joinFieldPath(path, "vault")
+		md.Vault = &vaultMetadata{Addr: d.str(vault, vaultPath, "addr", "", false)}
+		if approle := d.object(vault, vaultPath, "approle", false); approle != nil {
+			approlePath := joinFieldPath(vaultPath, "approle")
+			md.Vault.AppRole.RoleID = d.str(approle, approlePath, "role_id", "", false)
+			md.Vault.AppRole.SecretID = d.str(approle, approlePath, "secret_id", "", false)
+		}
+	}
+
+	return md
+}
+
+func (d *metadataDecoder) decodeIAM(fields map[string]interface{}, path string) *iamMetadata {
+	iam := &iamMetadata{
+		RoleName: d.str(fields, path, "role-name", "", false),
+		RoleArn:  d.str(fields, path, "role-arn", "", false),
+	}
+	if profile := d.object(fields, path, "instance-profile", false); len(profile) != 0 {
+		profilePath := joinFieldPath(path, "instance-profile")
+		iam.InstanceProfile = &instanceProfile{
+			Arn: d.str(profile, profilePath, "arn", "", false),
+			ID:  d.str(profile, profilePath, "id", "", false),
+		}
+	}
+	if creds := d.object(fields, path, "credentials", false); len(creds) != 0 {
+		iam.Credentials = d.decodeCredentials(creds, joinFieldPath(path, "credentials"))
+	}
+	return iam
+}
+
+func (d *metadataDecoder) decodeCredentials(
+	fields map[string]interface{},
+	path string,
+) *metadataCredentials {
+	return &metadataCredentials{
+		AccessKeyID:     d.str(fields, path, "AccessKeyId", "", true),
+		SecretAccessKey: d.str(fields, path, "SecretAccessKey", "", true),
+		Token:           d.str(fields, path, "Token", "", false),
+		Code:            d.str(fields, path, "Code", "Success", false),
+		Expiration:      d.str(fields, path, "Expiration", "", false),
+		LastUpdated:     d.str(fields, path, "LastUpdated", "", false),
+		Type:            d.str(fields, path, "Type", "AWS-HMAC", false),
+	}
+}
+
+// regionFromAZ returns the region of an availability zone, such as
+// us-west-2 for us-west-2a, or an empty string if az does not end in a
+// zone letter.  It is only used when the merged instance data has no
+// region, so that e.g. an imds.az override does not replace the region
+// of the layers below.
+func regionFromAZ(az string) string {
+	if len(az) < 2 {
+		return ""
+	}
+	if last := az[len(az)-1]; last < 'a' || last > 'z' {
+		return ""
+	}
+	return az[:len(az)-1]
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeInstanceData(t *testing.T) {
+	md := decodeInstanceData(baseTestData())
+	if len(md.errs) != 0 {
+		t.Fatalf("unexpected errors: %v", md.errs)
+	}
+	if md.V1.InstanceID != "i-test-1234" || md.V1.Region != "us-west-2" {
+		t.Errorf("unexpected v1: %+v", md.V1)
+	}
+	if md.DS.InstanceType != "m7g.metal-48xl" || md.DS.Tags["Name"] != "test-instance" {
+		t.Errorf("unexpected ds: %+v", md.DS)
+	}
+	if md.DS.IAM == nil || md.DS.IAM.RoleName != "test-role" ||
+		md.DS.IAM.Credentials == nil || md.DS.IAM.Credentials.Token != "tok" {
+		t.Errorf("unexpected iam: %+v", md.DS.IAM)
+	}
+}
+
+func TestDecodeInstanceDataErrors(t *testing.T) {
+	data := baseTestData()
+	data["v1"].(map[string]interface{})["region"] = 42
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["tags"].(map[string]interface{})["Count"] = 3.0
+	delete(md, "instance_type")
+
+	decoded := decodeInstanceData(data)
+	if err := decoded.check("v1.region"); err == nil ||
+		err.Error() != "v1.region value is not a string" {
+		t.Errorf("unexpected error for region: %v", err)
+	}
+	if err := decoded.check("ds.meta_data.tags"); err == nil ||
+		err.Error() != "ds.meta_data.tags.Count value is not a string" {
+		t.Errorf("unexpected error for tags: %v", err)
+	}
+	if err := decoded.check("v1.instance_id", "ds.meta_data.instance_type"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if decoded.DS.InstanceType != "t2.micro" {
+		t.Errorf("expected default instance type, got %q", decoded.DS.InstanceType)
+	}
+}
+
+func TestMetadataDecodedOncePerSnapshot(t *testing.T) {
+	s := newTestServer(t, baseTestData())
+	first, err := s.getMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.getMetadata("v1.instance_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the decoded instance data to be reused")
+	}
+
+	s.dataSource = &mockInstanceData{data: baseTestData()}
+	third, err := s.getMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Error("expected a new snapshot to be decoded")
+	}
+}
+
+// Malformed instance data used to crash the server through unchecked type
+// assertions; it must now produce error responses.
+func TestMalformedInstanceData(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(data map[string]interface{})
+		path   string
+		code   int
+		body   string
+	}{
+		{
+			name: "v1 not an object",
+			modify: func(data map[string]interface{}) {
+				data["v1"] = "oops"
+			},
+			path: "/latest/meta-data/instance-id",
+			code: http.StatusInternalServerError,
+			body: "v1 value is not a map",
+		},
+		{
+			name: "non-string tag",
+			modify: func(data map[string]interface{}) {
+				md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+				md["tags"].(map[string]interface{})["Name"] = 1.0
+			},
+			path: "/latest/meta-data/tags/instance/Name",
+			code: http.StatusInternalServerError,
+			body: "ds.meta_data.tags.Name value is not a string",
+		},
+		{
+			name: "non-string endpoint",
+			modify: func(data map[string]interface{}) {
+				md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+				md["services"] = map[string]interface{}{
+					"endpoints": map[string]interface{}{"sts": true},
+				}
+			},
+			path: "/latest/meta-data/services/endpoints",
+			code: http.StatusInternalServerError,
+			body: "ds.meta_data.services.endpoints.sts value is not a string",
+		},
+		{
+			name: "non-string tag does not affect other paths",
+			modify: func(data map[string]interface{}) {
+				md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+				md["tags"].(map[string]interface{})["Name"] = 1.0
+			},
+			path: "/latest/meta-data/instance-id",
+			code: http.StatusOK,
+			body: "i-test-1234",
+		},
+	}
+	for _, tt := range tests {
+		data := baseTestData()
+		tt.modify(data)
+		s := newTestServer(t, data)
+
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: expected %d %q, got %d %q",
+				tt.name, tt.code, tt.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestIAMCredentialsWithoutToken(t *testing.T) {
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	creds := md["iam"].(map[string]interface{})["credentials"].(map[string]interface{})
+	delete(creds, "Token")
+	s := newTestServer(t, data)
+
+	_, imdsCreds, _, err := s.getIAMCredentials()
+	if err != nil {
+		t.Fatalf("getIAMCredentials: %v", err)
+	}
+	if imdsCreds.AccessKeyID != "AKIATEST" || imdsCreds.Token != "" {
+		t.Errorf("unexpected credentials %+v", imdsCreds)
+	}
+
+	delete(creds, "AccessKeyId")
+	s = newTestServer(t, data)
+	_, _, _, err = s.getIAMCredentials()
+	if err == nil || err.Error() != "ds.meta_data.iam.credentials.AccessKeyId is missing in metadata" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRedactedCredentialsRefused(t *testing.T) {
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	iam := md["iam"].(map[string]interface{})
+	iam["credentials"] = redactedPlaceholder
+	s := newTestServer(t, data)
+
+	_, _, _, err := s.getIAMCredentials()
+	if err == nil || err.Error() != "ds.meta_data.iam.credentials is redacted for non-root user" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	iam["credentials"] = map[string]interface{}{
+		"AccessKeyId":     "AKIATEST",
+		"SecretAccessKey": redactedPlaceholder,
+		"Expiration":      "2099-01-01T00:00:00Z",
+	}
+	s = newTestServer(t, data)
+	if _, _, _, err := s.getIAMCredentials(); err == nil {
+		t.Error("expected error for redacted secret key")
+	}
+
+	// Other paths are not affected.
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/latest/meta-data/instance-id", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestRegionFromAvailabilityZone(t *testing.T) {
+	data := baseTestData()
+	v1 := data["v1"].(map[string]interface{})
+	delete(v1, "region")
+	v1["availability_zone"] = "lab-1a"
+	if md := decodeInstanceData(data); md.V1.Region != "lab-1" || md.check("v1.region") != nil {
+		t.Errorf("expected region derived from the zone, got %q: %v", md.V1.Region, md.check("v1.region"))
+	}
+
+	v1["availability_zone"] = "lab-1"
+	if err := decodeInstanceData(data).check("v1.region"); err == nil {
+		t.Error("expected error without region or zone letter")
+	}
+}
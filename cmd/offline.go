@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	offlineProvName = "OfflineProvider"
+	stsXMLNS        = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+	minOfflineDuration = 15 * time.Minute
+	maxOfflineDuration = 12 * time.Hour
+)
+
+var stsCredentialRe = regexp.MustCompile(`Credential=([A-Z0-9]+)/`)
+
+// offlineSession is a set of credentials minted by offlineSTS.
+type offlineSession struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+	RoleArn         string
+	AssumedRoleArn  string
+	AssumedRoleID   string
+}
+
+// offlineSTS mints realistic-looking temporary credentials without talking
+// to AWS, and remembers them so that its STS endpoint can answer
+// GetCallerIdentity for them.
+type offlineSTS struct {
+	accountID string
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]offlineSession
+}
+
+func newOfflineSTS(accountID string, ttl time.Duration) *offlineSTS {
+	return &offlineSTS{
+		accountID: accountID,
+		ttl:       ttl,
+		sessions:  make(map[string]offlineSession),
+	}
+}
+
+func randomString(n int, encode func([]byte) string) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return encode(buf)
+}
+
+// mint issues new credentials for roleArn, valid for ttl.
+func (o *offlineSTS) mint(roleArn string, sessionName string, ttl time.Duration) offlineSession {
+	roleName := roleNameFromArn(roleArn)
+	roleID := "AROA" + randomString(10, base32.StdEncoding.EncodeToString)[:16]
+	accountID := o.accountID
+	if parsed, err := arn.Parse(roleArn); err == nil && parsed.AccountID != "" {
+		accountID = parsed.AccountID
+	}
+
+	sess := offlineSession{
+		AccessKeyID:     "ASIA" + randomString(10, base32.StdEncoding.EncodeToString)[:16],
+		SecretAccessKey: randomString(30, base64.StdEncoding.EncodeToString),
+		SessionToken:    randomString(192, base64.StdEncoding.EncodeToString),
+		Expiration:      time.Now().UTC().Add(ttl).Truncate(time.Second),
+		RoleArn:         roleArn,
+		AssumedRoleArn: fmt.Sprintf("arn:aws:sts::%s:assumed-role/%s/%s",
+			accountID, roleName, sessionName),
+		AssumedRoleID: roleID + ":" + sessionName,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	for key, old := range o.sessions {
+		if now.After(old.Expiration) {
+			delete(o.sessions, key)
+		}
+	}
+	o.sessions[sess.AccessKeyID] = sess
+	return sess
+}
+
+func (o *offlineSTS) lookup(accessKeyID string) (offlineSession, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	sess, ok := o.sessions[accessKeyID]
+	return sess, ok
+}
+
+// offlineProvider is a credentials.Provider backed by offlineSTS.
+type offlineProvider struct {
+	credentials.Expiry
+
+	sts     *offlineSTS
+	roleArn string
+	// sessionName defaults to i-offline.
+	sessionName string
+}
+
+// Retrieve mints a new set of credentials for the served role.
+func (p *offlineProvider) Retrieve() (credentials.Value, error) {
+	sessionName := p.sessionName
+	if sessionName == "" {
+		sessionName = "i-offline"
+	}
+	sess := p.sts.mint(p.roleArn, sessionName, p.sts.ttl)
+	p.SetExpiration(sess.Expiration, 0)
+	klog.Infof("minted offline credentials %s for %s", sess.AccessKeyID, p.roleArn)
+	return credentials.Value{
+		AccessKeyID:     sess.AccessKeyID,
+		SecretAccessKey: sess.SecretAccessKey,
+		SessionToken:    sess.SessionToken,
+		ProviderName:    offlineProvName,
+	}, nil
+}
+
+type stsCredentials struct {
+	AccessKeyID     string `xml:"AccessKeyId"`
+	SecretAccessKey string `xml:"SecretAccessKey"`
+	SessionToken    string `xml:"SessionToken"`
+	Expiration      string `xml:"Expiration"`
+}
+
+type stsResponseMetadata struct {
+	RequestID string `xml:"RequestId"`
+}
+
+type stsAssumeRoleResponse struct {
+	XMLName xml.Name `xml:"AssumeRoleResponse"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Result  struct {
+		AssumedRoleUser struct {
+			AssumedRoleID string `xml:"AssumedRoleId"`
+			Arn           string `xml:"Arn"`
+		} `xml:"AssumedRoleUser"`
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleResult"`
+	ResponseMetadata stsResponseMetadata `xml:"ResponseMetadata"`
+}
+
+type stsGetCallerIdentityResponse struct {
+	XMLName xml.Name `xml:"GetCallerIdentityResponse"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Arn     string `xml:"Arn"`
+		UserID  string `xml:"UserId"`
+		Account string `xml:"Account"`
+	} `xml:"GetCallerIdentityResult"`
+	ResponseMetadata stsResponseMetadata `xml:"ResponseMetadata"`
+}
+
+type stsErrorResponse struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Error   struct {
+		Type    string `xml:"Type"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+	RequestID string `xml:"RequestId"`
+}
+
+// Handler returns an http.Handler implementing the AssumeRole and
+// GetCallerIdentity actions of the STS query API.  Request signatures are
+// not verified; callers are identified by the access key in their
+// Authorization header.
+func (o *offlineSTS) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeSTSError(w, http.StatusBadRequest, "MalformedInput", err.Error())
+			return
+		}
+		klog.V(5).Infof("STS %s %s", r.RemoteAddr, r.Form.Get("Action"))
+
+		switch r.Form.Get("Action") {
+		case "AssumeRole":
+			o.assumeRole(w, r)
+		case "GetCallerIdentity":
+			o.getCallerIdentity(w, r)
+		default:
+			writeSTSError(w, http.StatusBadRequest, "InvalidAction",
+				fmt.Sprintf("Could not find operation %s", r.Form.Get("Action")))
+		}
+	})
+}
+
+func (o *offlineSTS) assumeRole(w http.ResponseWriter, r *http.Request) {
+	roleArn := r.Form.Get("RoleArn")
+	sessionName := r.Form.Get("RoleSessionName")
+	if _, err := arn.Parse(roleArn); err != nil || sessionName == "" {
+		writeSTSError(w, http.StatusBadRequest, "ValidationError",
+			"RoleArn and RoleSessionName are required")
+		return
+	}
+
+	ttl := time.Hour
+	if v := r.Form.Get("DurationSeconds"); v != "" {
+		secs, err := strconv.Atoi(v)
+		ttl = time.Duration(secs) * time.Second
+		if err != nil || ttl < minOfflineDuration || ttl > maxOfflineDuration {
+			writeSTSError(w, http.StatusBadRequest, "ValidationError",
+				"DurationSeconds is out of range")
+			return
+		}
+	}
+
+	sess := o.mint(roleArn, sessionName, ttl)
+	resp := stsAssumeRoleResponse{XMLNS: stsXMLNS}
+	resp.Result.AssumedRoleUser.AssumedRoleID = sess.AssumedRoleID
+	resp.Result.AssumedRoleUser.Arn = sess.AssumedRoleArn
+	resp.Result.Credentials = stsCredentials{
+		AccessKeyID:     sess.AccessKeyID,
+		SecretAccessKey: sess.SecretAccessKey,
+		SessionToken:    sess.SessionToken,
+		Expiration:      sess.Expiration.Format(time.RFC3339),
+	}
+	resp.ResponseMetadata.RequestID = newRequestID()
+	writeSTSResponse(w, resp)
+}
+
+func (o *offlineSTS) getCallerIdentity(w http.ResponseWriter, r *http.Request) {
+	m := stsCredentialRe.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		writeSTSError(w, http.StatusForbidden, "MissingAuthenticationToken",
+			"Request is missing Authentication Token")
+		return
+	}
+	sess, ok := o.lookup(m[1])
+	if !ok {
+		writeSTSError(w, http.StatusForbidden, "InvalidClientTokenId",
+			"The security token included in the request is invalid.")
+		return
+	}
+
+	resp := stsGetCallerIdentityResponse{XMLNS: stsXMLNS}
+	resp.Result.Arn = sess.AssumedRoleArn
+	resp.Result.UserID = sess.AssumedRoleID
+	resp.Result.Account = o.accountID
+	if parsed, err := arn.Parse(sess.AssumedRoleArn); err == nil {
+		resp.Result.Account = parsed.AccountID
+	}
+	resp.ResponseMetadata.RequestID = newRequestID()
+	writeSTSResponse(w, resp)
+}
+
+func writeSTSResponse(w http.ResponseWriter, resp interface{}) {
+	data, err := xml.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(data)
+}
+
+func writeSTSError(w http.ResponseWriter, status int, code string, msg string) {
+	resp := stsErrorResponse{XMLNS: stsXMLNS, RequestID: newRequestID()}
+	resp.Error.Type = "Sender"
+	resp.Error.Code = code
+	resp.Error.Message = msg
+	data, _ := xml.Marshal(resp)
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func newRequestID() string {
+	id := randomString(16, hex.EncodeToString)
+	return strings.Join([]string{id[:8], id[8:12], id[12:16], id[16:20], id[20:]}, "-")
+}
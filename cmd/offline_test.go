@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestOfflineProviderRotates(t *testing.T) {
+	o := newOfflineSTS("123456789012", time.Hour)
+	creds := credentials.NewCredentials(&offlineProvider{
+		sts:     o,
+		roleArn: "arn:aws:iam::123456789012:role/lab",
+	})
+	fetch := refreshingFetcher(creds)
+
+	if _, err := fetch(); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	first, _ := creds.Get()
+	if _, err := fetch(); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	second, _ := creds.Get()
+
+	if !strings.HasPrefix(first.AccessKeyID, "ASIA") || len(first.AccessKeyID) != 20 {
+		t.Errorf("unexpected access key ID %q", first.AccessKeyID)
+	}
+	if len(first.SecretAccessKey) != 40 {
+		t.Errorf("unexpected secret length %d", len(first.SecretAccessKey))
+	}
+	if first.AccessKeyID == second.AccessKeyID || first.SessionToken == second.SessionToken {
+		t.Error("expected rotated credentials to differ")
+	}
+	expiresAt, err := creds.ExpiresAt()
+	if err != nil || time.Until(expiresAt) < 59*time.Minute {
+		t.Errorf("unexpected expiry %v (%v)", expiresAt, err)
+	}
+}
+
+func TestOfflineSTSEndpoint(t *testing.T) {
+	o := newOfflineSTS("123456789012", time.Hour)
+	srv := httptest.NewServer(o.Handler())
+	defer srv.Close()
+
+	newClient := func(creds *credentials.Credentials) *sts.STS {
+		sess := session.Must(session.NewSession(aws.NewConfig().
+			WithRegion("us-east-1").
+			WithEndpoint(srv.URL).
+			WithCredentials(creds)))
+		return sts.New(sess)
+	}
+
+	out, err := newClient(credentials.NewStaticCredentials("AKIABOOT", "x", "")).
+		AssumeRole(&sts.AssumeRoleInput{
+			RoleArn:         aws.String("arn:aws:iam::210987654321:role/app"),
+			RoleSessionName: aws.String("test"),
+			DurationSeconds: aws.Int64(900),
+		})
+	if err != nil {
+		t.Fatalf("AssumeRole: %v", err)
+	}
+	if got := aws.StringValue(out.AssumedRoleUser.Arn); got != "arn:aws:sts::210987654321:assumed-role/app/test" {
+		t.Errorf("unexpected assumed role ARN %q", got)
+	}
+	if d := time.Until(aws.TimeValue(out.Credentials.Expiration)); d > 15*time.Minute || d < 14*time.Minute {
+		t.Errorf("unexpected credential lifetime %v", d)
+	}
+
+	c := out.Credentials
+	ident, err := newClient(credentials.NewStaticCredentials(
+		aws.StringValue(c.AccessKeyId),
+		aws.StringValue(c.SecretAccessKey),
+		aws.StringValue(c.SessionToken),
+	)).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		t.Fatalf("GetCallerIdentity: %v", err)
+	}
+	if aws.StringValue(ident.Account) != "210987654321" ||
+		aws.StringValue(ident.Arn) != aws.StringValue(out.AssumedRoleUser.Arn) {
+		t.Errorf("unexpected caller identity: %v", ident)
+	}
+
+	_, err = newClient(credentials.NewStaticCredentials("AKIAUNKNOWN", "x", "")).
+		GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err == nil || !strings.Contains(err.Error(), "InvalidClientTokenId") {
+		t.Errorf("expected InvalidClientTokenId, got %v", err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 )
@@ -32,19 +33,235 @@ type Options struct {
 	Port      string
 	NetIface  string
 	AccountID string
+
+	// UnixSocket additionally serves IMDS on a unix socket.
+	UnixSocket      string
+	UnixSocketMode  os.FileMode
+	UnixSocketGroup string
+
+	// CredentialSource selects where role credentials come from.
+	CredentialSource string
+	// CredentialRefreshInterval overrides the refresh schedule derived
+	// from credential expiry when non-zero.
+	CredentialRefreshInterval time.Duration
+	// IAMRoleName and IAMRoleArn describe the served role for credential
+	// sources that do not read it from metadata.
+	IAMRoleName string
+	IAMRoleArn  string
+
+	// RoleMappingFile maps local callers to per-process roles.
+	RoleMappingFile string
+
+	// PodRoleResolver selects how client IPs are mapped to pod roles.
+	PodRoleResolver        string
+	PodRoleFile            string
+	PodRoleAnnotation      string
+	PodDefaultRoleArn      string
+	PodDefaultInstanceRole bool
+
+	KubeAPIServer string
+	KubeTokenFile string
+	KubeCAFile    string
+	KubeNodeName  string
+
+	// ContainerCredentialsListen enables the ECS container credentials
+	// endpoint on this address.
+	ContainerCredentialsListen string
+	ContainerAuthTokenFile     string
+	// ECSContainerDefinitionsFile describes the containers served by the
+	// ECS task metadata endpoint.
+	ECSContainerDefinitionsFile string
+	// TaskMetadataListen serves the ECS task metadata endpoint on this
+	// address, without the container credentials endpoint.
+	TaskMetadataListen string
+
+	// PodIdentityListen enables the EKS Pod Identity Agent compatible
+	// endpoint on this address.
+	PodIdentityListen           string
+	PodIdentityAssociationsFile string
+	PodIdentityAudience         string
+	PodIdentityClusterName      string
+
+	// InstanceData is the cloud-init instance data file, with the
+	// instance-data-sensitive.json next to it.  InstanceDataOverrides and
+	// then the files in InstanceDataDir are merged over it, in order.
+	InstanceData          string
+	InstanceDataOverrides stringList
+	InstanceDataDir       string
+
+	// DMI layers instance data derived from SMBIOS, read from the sysfs
+	// at SysfsRoot, under the cloud-init instance data.
+	DMI       bool
+	SysfsRoot string
+	// FwCfgEntry is a QEMU fw_cfg entry, such as opt/com.example/imds,
+	// holding instance data layered under the cloud-init instance data.
+	FwCfgEntry string
+
+	// KernelCmdline is read for imds.* parameters, which take precedence
+	// over all instance data, along with IMDS_* environment variables.
+	KernelCmdline string
+	// DebugOverrides serves the list of overrides at /debug/overrides.
+	DebugOverrides bool
+
+	// PathMappingFile defines IMDS paths by JMESPath expressions over the
+	// instance data.
+	PathMappingFile string
+	// OverlayDir is a directory tree served as metadata over all other
+	// paths.
+	OverlayDir string
+
+	// CredentialFileSyncs are shared credentials files rewritten on
+	// every credential refresh.
+	CredentialFileSyncs credentialFileSyncs
+
+	// AuditLog is a JSON-lines log of credential reads, rotated when it
+	// exceeds AuditLogMaxSize bytes.
+	AuditLog           string
+	AuditLogMaxSize    int64
+	AuditLogMaxBackups int
+
+	CredentialProcess string
+
+	VaultAddr         string
+	VaultAuthMethod   string
+	VaultAuthMount    string
+	VaultRoleID       string
+	VaultSecretIDFile string
+	VaultTokenFile    string
+	VaultClientCert   string
+	VaultClientKey    string
+	VaultCACert       string
+	VaultAWSPath      string
+
+	AWSProfile         string
+	AWSConfigFile      string
+	AWSCredentialsFile string
+	AWSSSOCacheDir     string
+
+	// Endpoint and transport settings for AWS API calls.
+	AWSUseFIPSEndpoint      bool
+	AWSUseDualStackEndpoint bool
+	AWSSTSRegionalEndpoints string
+	AWSHTTPSProxy           string
+	AWSCABundle             string
+
+	OfflineCredentialTTL time.Duration
+	OfflineSTSListen     string
+
+	RolesAnywhereCertificate     string
+	RolesAnywherePrivateKey      string
+	RolesAnywhereTrustAnchorArn  string
+	RolesAnywhereProfileArn      string
+	RolesAnywhereRoleArn         string
+	RolesAnywhereSessionDuration time.Duration
 }
 
+const (
+	credentialSourceMetadata      = "metadata"
+	credentialSourceRolesAnywhere = "rolesanywhere"
+	credentialSourceProcess       = "process"
+	credentialSourceVault         = "vault"
+	credentialSourceProfile       = "profile"
+	credentialSourceOffline       = "offline"
+)
+
+const (
+	podRoleResolverFile       = "file"
+	podRoleResolverKubernetes = "kubernetes"
+)
+
 func GetOptions(fs *flag.FlagSet) *Options {
 	var (
-		version   = fs.Bool("version", false, "Print the version and exit.")
-		bindTo    = fs.String("bind-to", "169.254.169.254", "Address to bind to.")
-		port      = fs.String("port", "80", "Port to bind to.")
-		iface     = fs.String("net-iface", "", "Network interface used for traffic.")
-		accountID = fs.String("account-id", "123456789012", "AWS account ID to return in instance identity document.")
+		version     = fs.Bool("version", false, "Print the version and exit.")
+		bindTo      = fs.String("bind-to", "169.254.169.254", "Address to bind to.")
+		port        = fs.String("port", "80", "Port to bind to.")
+		iface       = fs.String("net-iface", "", "Network interface used for traffic.")
+		accountID   = fs.String("account-id", "123456789012", "AWS account ID to return in instance identity document.")
+		unixSocket  = fs.String("unix-socket", "", "Also serve IMDS on this unix socket; disabled if empty.")
+		unixMode    = fs.Uint("unix-socket-mode", 0o660, "Permissions of -unix-socket.")
+		unixGroup   = fs.String("unix-socket-group", "", "Group owning -unix-socket, by name or number (default: the group of the server process).")
+		credSrc     = fs.String("credential-source", credentialSourceMetadata, "Source of IAM role credentials (metadata, rolesanywhere, process, vault, profile, offline).")
+		credRefresh = fs.Duration("credential-refresh-interval", 0, "Fixed credential refresh interval (default: half of the remaining credential lifetime).")
+		roleName    = fs.String("iam-role-name", "", "Role name served under iam/security-credentials (defaults to the name in the role ARN).")
+		roleArn     = fs.String("iam-role-arn", "", "ARN of the served role for credential sources that do not define one.")
+		roleMap     = fs.String("role-mapping-file", "", "JSON file mapping local UIDs, users or systemd units to IAM roles.")
+
+		podResolver   = fs.String("pod-role-resolver", "", "Serve per-pod roles by client IP using this resolver (file, kubernetes).")
+		podRoleFile   = fs.String("pod-role-file", "", "JSON file mapping pod IPs or CIDRs to roles, used by the file pod role resolver.")
+		podAnnotation = fs.String("pod-role-annotation", defaultPodRoleAnnotation, "Pod annotation holding the role ARN.")
+		podDefaultArn = fs.String("pod-default-role-arn", "", "Role served to pods without a role.")
+		podDefaultIR  = fs.Bool("pod-default-instance-role", false, "Serve the instance role to pods without a role.")
+		kubeAPI       = fs.String("kube-api-server", "", "Kubernetes API server URL (defaults to the in-cluster service).")
+		kubeToken     = fs.String("kube-token-file", defaultKubeTokenFile, "Kubernetes service account token file.")
+		kubeCA        = fs.String("kube-ca-file", defaultKubeCAFile, "Kubernetes API server CA bundle.")
+		kubeNode      = fs.String("kube-node-name", os.Getenv("NODE_NAME"), "Only consider pods scheduled to this node.")
+
+		containerListen = fs.String("container-credentials-listen", "", "Address for the ECS container credentials endpoint, e.g. 169.254.170.2:80; disabled if empty.")
+		containerToken  = fs.String("container-authorization-token-file", "", "File with the token container credentials clients must send (AWS_CONTAINER_AUTHORIZATION_TOKEN).")
+		ecsContainers   = fs.String("ecs-container-definitions-file", "", "JSON file describing local containers; enables the ECS task metadata endpoint v4 on the container endpoint.")
+		taskMetaListen  = fs.String("ecs-task-metadata-listen", "", "Address for the ECS task metadata endpoint v4 alone, without container credentials; requires -ecs-container-definitions-file.")
+
+		podIdentityListen   = fs.String("pod-identity-listen", "", "Address for the EKS Pod Identity Agent compatible endpoint, e.g. 169.254.170.23:80; disabled if empty.")
+		podIdentityAssoc    = fs.String("pod-identity-associations-file", "", "JSON file mapping namespace/service account pairs to role ARNs.")
+		podIdentityAudience = fs.String("pod-identity-audience", defaultPodIdentityAudience, "Audience required of pod identity service account tokens.")
+		podIdentityCluster  = fs.String("pod-identity-cluster-name", "", "Cluster name passed as the eks-cluster-name session tag.")
+
+		instanceData    = fs.String("instance-data", "/run/cloud-init/instance-data.json", "cloud-init instance data file.")
+		instanceDataDir = fs.String("instance-data-dir", "", "Directory of YAML or JSON files merged over the instance data in lexical order, e.g. /etc/cloud-init-aws-imds.d.")
+		overrides       stringList
+		dmi             = fs.Bool("dmi", false, "Derive instance data from SMBIOS (instance ID, type, AZ and tags), used where the cloud-init instance data leaves fields out.")
+		fwCfgEntry      = fs.String("fw-cfg-entry", "", "QEMU fw_cfg entry with JSON instance data, e.g. opt/com.example/imds, used where the cloud-init instance data leaves fields out; disabled if empty.")
+		kernelCmdline   = fs.String("kernel-cmdline", "/proc/cmdline", "Kernel command line read for imds.<key>=<value> instance data overrides; disabled if empty.")
+		debugOverrides  = fs.Bool("debug-overrides", false, "Serve the active kernel command line and environment overrides at /debug/overrides, to every client that can reach the server.")
+		sysfsRoot       = fs.String("sysfs-root", "/sys", "Mount point of sysfs, read for SMBIOS and fw_cfg data.")
+		overlayDir      = fs.String("overlay-dir", "", "Directory tree served at the matching /latest/ paths, over the computed metadata, e.g. /etc/imds.")
+		pathMapping     = fs.String("path-mapping-file", "", "YAML or JSON file defining IMDS paths by JMESPath expressions over the instance data.")
+
+		credFileSyncs credentialFileSyncs
+
+		auditLog        = fs.String("audit-log", "", "Append a JSON line for every credential read to this file; disabled if empty.")
+		auditMaxSize    = fs.Int64("audit-log-max-size", 100<<20, "Rotate the audit log when it exceeds this many bytes (0 disables rotation).")
+		auditMaxBackups = fs.Int("audit-log-max-backups", 5, "Number of rotated audit logs to keep.")
+
+		credProc = fs.String("credential-process", "", "Command printing credential_process JSON, used by the process credential source.")
+
+		vaultAddr       = fs.String("vault-addr", "", "Vault server address (defaults to ds.meta_data.vault.addr).")
+		vaultAuth       = fs.String("vault-auth-method", vaultAuthAppRole, "Vault auth method (approle, cert, token).")
+		vaultMount      = fs.String("vault-auth-mount", "", "Vault auth mount path (defaults to the auth method name).")
+		vaultRoleID     = fs.String("vault-role-id", "", "Vault AppRole role ID (defaults to ds.meta_data.vault.approle.role_id).")
+		vaultSecretID   = fs.String("vault-secret-id-file", "", "File with the Vault AppRole secret ID (defaults to ds.meta_data.vault.approle.secret_id).")
+		vaultTokenFile  = fs.String("vault-token-file", "", "File with a Vault token, used by the token auth method.")
+		vaultClientCert = fs.String("vault-client-cert", "", "PEM client certificate for Vault TLS and cert login.")
+		vaultClientKey  = fs.String("vault-client-key", "", "PEM private key for -vault-client-cert.")
+		vaultCACert     = fs.String("vault-ca-cert", "", "PEM CA bundle used to verify the Vault server.")
+		vaultAWSPath    = fs.String("vault-aws-path", "", "Vault path to read AWS credentials from, e.g. aws/sts/<role> or aws/creds/<role>.")
+
+		awsProfile     = fs.String("aws-profile", "default", "Shared config profile used by the profile credential source.")
+		awsConfigFile  = fs.String("aws-config-file", "", "AWS shared config file (defaults to ~/.aws/config).")
+		awsCredsFile   = fs.String("aws-credentials-file", "", "AWS shared credentials file (defaults to ~/.aws/credentials).")
+		awsSSOCacheDir = fs.String("aws-sso-cache-dir", "", "AWS SSO token cache directory (defaults to ~/.aws/sso/cache).")
+
+		awsFIPS      = fs.Bool("aws-use-fips-endpoint", false, "Use FIPS endpoints for STS and other AWS calls.")
+		awsDualStack = fs.Bool("aws-use-dualstack-endpoint", false, "Use dual-stack (IPv4 and IPv6) AWS endpoints.")
+		awsSTSRegion = fs.String("aws-sts-regional-endpoints", "", "STS endpoint selection: regional or legacy (global); defaults to the SDK default.")
+		awsProxy     = fs.String("aws-https-proxy", "", "HTTPS proxy URL for AWS API calls.")
+		awsCABundle  = fs.String("aws-ca-bundle", "", "PEM CA bundle trusted for AWS API calls, in addition to the system roots.")
+
+		offlineTTL = fs.Duration("offline-credential-ttl", time.Hour, "Lifetime of credentials minted by the offline credential source.")
+		offlineSTS = fs.String("offline-sts-listen", "", "Address for the offline STS endpoint (AssumeRole, GetCallerIdentity); disabled if empty.")
+
+		raCert     = fs.String("rolesanywhere-certificate", "", "PEM file with the X.509 certificate (and optional chain) used for IAM Roles Anywhere.")
+		raKey      = fs.String("rolesanywhere-private-key", "", "PEM file with the private key matching -rolesanywhere-certificate.")
+		raAnchor   = fs.String("rolesanywhere-trust-anchor-arn", "", "IAM Roles Anywhere trust anchor ARN.")
+		raProfile  = fs.String("rolesanywhere-profile-arn", "", "IAM Roles Anywhere profile ARN.")
+		raRole     = fs.String("rolesanywhere-role-arn", "", "ARN of the role to assume through IAM Roles Anywhere.")
+		raDuration = fs.Duration("rolesanywhere-session-duration", time.Hour, "Requested IAM Roles Anywhere session duration.")
 
 		args = os.Args[1:]
 	)
 
+	fs.Var(&credFileSyncs, "sync-credentials-file", "Keep a shared credentials file up to date, as path[,profile=name][,owner=user[:group]][,mode=0600]; may be repeated.")
+	fs.Var(&overrides, "instance-data-override", "YAML or JSON file merged over the instance data; may be repeated, later files taking precedence.")
 	klog.InitFlags(fs)
 
 	if err := fs.Parse(args); err != nil {
@@ -76,5 +293,101 @@ func GetOptions(fs *flag.FlagSet) *Options {
 		Port:      *port,
 		NetIface:  *iface,
 		AccountID: *accountID,
+
+		UnixSocket:      *unixSocket,
+		UnixSocketMode:  os.FileMode(*unixMode),
+		UnixSocketGroup: *unixGroup,
+
+		CredentialSource:          *credSrc,
+		CredentialRefreshInterval: *credRefresh,
+		IAMRoleName:               *roleName,
+		IAMRoleArn:                *roleArn,
+		RoleMappingFile:           *roleMap,
+		CredentialProcess:         *credProc,
+		CredentialFileSyncs:       credFileSyncs,
+
+		InstanceData:          *instanceData,
+		InstanceDataOverrides: overrides,
+		InstanceDataDir:       *instanceDataDir,
+		DMI:                   *dmi,
+		SysfsRoot:             *sysfsRoot,
+		FwCfgEntry:            *fwCfgEntry,
+		KernelCmdline:         *kernelCmdline,
+		DebugOverrides:        *debugOverrides,
+		PathMappingFile:       *pathMapping,
+		OverlayDir:            *overlayDir,
+
+		AuditLog:           *auditLog,
+		AuditLogMaxSize:    *auditMaxSize,
+		AuditLogMaxBackups: *auditMaxBackups,
+
+		PodRoleResolver:        *podResolver,
+		PodRoleFile:            *podRoleFile,
+		PodRoleAnnotation:      *podAnnotation,
+		PodDefaultRoleArn:      *podDefaultArn,
+		PodDefaultInstanceRole: *podDefaultIR,
+
+		KubeAPIServer: *kubeAPI,
+		KubeTokenFile: *kubeToken,
+		KubeCAFile:    *kubeCA,
+		KubeNodeName:  *kubeNode,
+
+		ContainerCredentialsListen: *containerListen,
+		ContainerAuthTokenFile:     *containerToken,
+
+		ECSContainerDefinitionsFile: *ecsContainers,
+		TaskMetadataListen:          *taskMetaListen,
+
+		PodIdentityListen:           *podIdentityListen,
+		PodIdentityAssociationsFile: *podIdentityAssoc,
+		PodIdentityAudience:         *podIdentityAudience,
+		PodIdentityClusterName:      *podIdentityCluster,
+
+		VaultAddr:         *vaultAddr,
+		VaultAuthMethod:   *vaultAuth,
+		VaultAuthMount:    *vaultMount,
+		VaultRoleID:       *vaultRoleID,
+		VaultSecretIDFile: *vaultSecretID,
+		VaultTokenFile:    *vaultTokenFile,
+		VaultClientCert:   *vaultClientCert,
+		VaultClientKey:    *vaultClientKey,
+		VaultCACert:       *vaultCACert,
+		VaultAWSPath:      *vaultAWSPath,
+
+		AWSProfile:         *awsProfile,
+		AWSConfigFile:      *awsConfigFile,
+		AWSCredentialsFile: *awsCredsFile,
+		AWSSSOCacheDir:     *awsSSOCacheDir,
+
+		AWSUseFIPSEndpoint:      *awsFIPS,
+		AWSUseDualStackEndpoint: *awsDualStack,
+		AWSSTSRegionalEndpoints: *awsSTSRegion,
+		AWSHTTPSProxy:           *awsProxy,
+		AWSCABundle:             *awsCABundle,
+
+		OfflineCredentialTTL: *offlineTTL,
+		OfflineSTSListen:     *offlineSTS,
+
+		RolesAnywhereCertificate:     *raCert,
+		RolesAnywherePrivateKey:      *raKey,
+		RolesAnywhereTrustAnchorArn:  *raAnchor,
+		RolesAnywhereProfileArn:      *raProfile,
+		RolesAnywhereRoleArn:         *raRole,
+		RolesAnywhereSessionDuration: *raDuration,
 	}
 }
+
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// fileOverlay serves a directory tree as metadata: the file
+// meta-data/placement/group-name under the root is served at
+// /latest/meta-data/placement/group-name.  The tree is read on every
+// request, so changes apply immediately.
+type fileOverlay struct {
+	root string
+	fsys fs.FS
+}
+
+// overlayExcluded are the paths under /latest/ the overlay never serves,
+// so that credentials always come from their handlers and are audited.
+var overlayExcluded = []string{
+	"meta-data/iam/security-credentials",
+	"meta-data/identity-credentials",
+}
+
+func newFileOverlay(root string) *fileOverlay {
+	return &fileOverlay{root: root, fsys: os.DirFS(root)}
+}
+
+// overlayHandler serves the paths present in the overlay, taking
+// precedence over next, and passes any other request on to next.
+//
+// A file is served with a single trailing newline removed, as written by
+// echo.  A directory is served as a listing of its entries, with a
+// trailing slash for subdirectories, merged with the listing next serves
+// for the same path, if any, so that e.g. an overlay tags/instance/Team
+// adds a tag rather than hiding the others.
+func (s *Server) overlayHandler(next http.Handler) http.Handler {
+	if s.overlay == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/latest/")
+		name = strings.TrimSuffix(name, "/")
+		if !ok || name == "" || !fs.ValidPath(name) || overlayExcludes(name) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		st, err := fs.Stat(s.overlay.fsys, name)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				klog.Warningf("overlay %s: %v", s.overlay.root, err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !st.IsDir() {
+			data, err := fs.ReadFile(s.overlay.fsys, name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%s", bytes.TrimSuffix(data, []byte("\n")))
+			return
+		}
+
+		entries, err := s.overlay.list(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		computed := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(computed, r)
+		if computed.status == http.StatusOK {
+			for _, line := range strings.Split(computed.body.String(), "\n") {
+				if line != "" {
+					entries = append(entries, line)
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s", strings.Join(dedupSorted(entries), "\n"))
+	})
+}
+
+// list returns the names of the entries in dir, with a trailing slash for
+// directories.  Hidden files, e.g. editor backups, are left out.
+func (o *fileOverlay) list(dir string) ([]string, error) {
+	entries, err := fs.ReadDir(o.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		isDir := e.IsDir()
+		if e.Type()&fs.ModeSymlink != 0 {
+			if st, err := fs.Stat(o.fsys, dir+"/"+e.Name()); err == nil {
+				isDir = st.IsDir()
+			}
+		}
+		if isDir {
+			names = append(names, e.Name()+"/")
+		} else {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func dedupSorted(names []string) []string {
+	sort.Strings(names)
+	result := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// bufferedResponse collects a response instead of sending it.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *bufferedResponse) WriteHeader(status int) { b.status = status }
+
+// overlayExcludes reports whether name is at or below an overlayExcluded
+// path.
+func overlayExcludes(name string) bool {
+	for _, excluded := range overlayExcluded {
+		if name == excluded || strings.HasPrefix(name, excluded+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileOverlay(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "meta-data/placement/group-name", "cluster-a\n")
+	writeTestFile(t, root, "meta-data/tags/instance/Team", "infra\n")
+	writeTestFile(t, root, "meta-data/tags/instance/.Team.swp", "")
+	writeTestFile(t, root, "meta-data/instance-type", "c7g.large")
+	writeTestFile(t, root, "meta-data/iam/security-credentials/test-role", "forged")
+
+	s := newTestServer(t, baseTestData())
+	s.overlay = newFileOverlay(root)
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/latest/meta-data/placement/group-name", http.StatusOK, "cluster-a"},
+		// The overlay takes precedence over the computed value.
+		{"/latest/meta-data/instance-type", http.StatusOK, "c7g.large"},
+		// Listings are merged with the computed listing.
+		{"/latest/meta-data/tags/instance", http.StatusOK, "Name\nTeam\naws:autoscaling:groupName"},
+		{"/latest/meta-data/tags/instance/Team", http.StatusOK, "infra"},
+		{"/latest/meta-data/tags/instance/Name", http.StatusOK, "test-instance"},
+		{"/latest/meta-data/placement/", http.StatusOK, "group-name"},
+		{"/latest/meta-data/instance-id", http.StatusOK, "i-test-1234"},
+		{"/latest/meta-data/iam/security-credentials/", http.StatusOK, "test-role"},
+	}
+	for _, tt := range tests {
+		if code, body := get(tt.path); code != tt.code || body != tt.body {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.path, tt.code, tt.body, code, body)
+		}
+	}
+
+	// Credentials are never served from the overlay.
+	if _, body := get("/latest/meta-data/iam/security-credentials/test-role"); body == "forged" {
+		t.Error("expected credentials to be served by their handler")
+	}
+
+	// Changes apply without a restart.
+	writeTestFile(t, root, "meta-data/placement/group-name", "cluster-b\n")
+	if _, body := get("/latest/meta-data/placement/group-name"); body != "cluster-b" {
+		t.Errorf("expected updated file, got %q", body)
+	}
+	if err := os.Remove(filepath.Join(root, "meta-data/instance-type")); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get("/latest/meta-data/instance-type"); body != "m7g.metal-48xl" {
+		t.Errorf("expected computed value after removal, got %q", body)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// instanceDataOverride is an imds.<key>=<value> setting given on the
+// kernel command line or as an IMDS_<KEY> environment variable.
+type instanceDataOverride struct {
+	// name is the setting as given, e.g. imds.az or IMDS_AZ, and key the
+	// imdsSettingsData key it sets.
+	name   string
+	key    string
+	value  string
+	source string
+}
+
+const (
+	overrideSourceCmdline = "kernel command line"
+	overrideSourceEnv     = "environment"
+)
+
+// readOverrides returns the imds.* parameters of the kernel command line
+// in cmdlinePath, if set, followed by the IMDS_* variables in environ,
+// so that the environment of the service takes precedence.
+//
+// In environment variable names, __ stands for a dot.  Path segments in
+// upper case are lowercased, while others keep their case, so that
+// IMDS_INSTANCE_TYPE sets instance_type, IMDS_V1__DISTRO v1.distro and
+// IMDS_DS__META_DATA__IAM__CREDENTIALS__AccessKeyId the AccessKeyId field.
+// Tag names keep their case: IMDS_TAG_Team sets tag.Team.
+func readOverrides(cmdlinePath string, environ []string) ([]instanceDataOverride, error) {
+	var overrides []instanceDataOverride
+	if cmdlinePath != "" {
+		cmdline, err := os.ReadFile(cmdlinePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, param := range splitCmdline(string(cmdline)) {
+			name, value, _ := strings.Cut(param, "=")
+			key, ok := strings.CutPrefix(name, "imds.")
+			if !ok || key == "" {
+				continue
+			}
+			overrides = append(overrides, instanceDataOverride{
+				name: name, key: key, value: value, source: overrideSourceCmdline,
+			})
+		}
+	}
+
+	for _, env := range environ {
+		name, value, _ := strings.Cut(env, "=")
+		key, ok := strings.CutPrefix(name, "IMDS_")
+		if !ok || key == "" {
+			continue
+		}
+		if tag, ok := strings.CutPrefix(key, "TAG_"); ok {
+			key = "tag." + tag
+		} else {
+			segments := strings.Split(key, "__")
+			for i, segment := range segments {
+				if segment == strings.ToUpper(segment) {
+					segments[i] = strings.ToLower(segment)
+				}
+			}
+			key = strings.Join(segments, ".")
+		}
+		overrides = append(overrides, instanceDataOverride{
+			name: name, key: key, value: value, source: overrideSourceEnv,
+		})
+	}
+	return overrides, nil
+}
+
+// splitCmdline splits a kernel command line into parameters.  Like the
+// kernel, it allows double quotes around values with spaces, e.g.
+// imds.tag.Name="web server", and removes them.
+func splitCmdline(cmdline string) []string {
+	var params []string
+	var param strings.Builder
+	quoted, inParam := false, false
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inParam = true
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if inParam {
+				params = append(params, param.String())
+				param.Reset()
+				inParam = false
+			}
+		default:
+			param.WriteRune(r)
+			inParam = true
+		}
+	}
+	if inParam {
+		params = append(params, param.String())
+	}
+	return params
+}
+
+// overrideInstanceData serves the instance data set by overrides, later
+// ones taking precedence.  It is the top layer of the instance data, and
+// does not change while the server runs.
+type overrideInstanceData struct {
+	snap *instanceDataSnapshot
+}
+
+func newOverrideInstanceData(overrides []instanceDataOverride) *overrideInstanceData {
+	settings := make(map[string]interface{}, len(overrides))
+	for _, o := range overrides {
+		settings[canonicalIMDSSetting(o.key)] = o.value
+	}
+	return &overrideInstanceData{snap: newInstanceDataSnapshot(imdsSettingsData(settings))}
+}
+
+func (o *overrideInstanceData) GetInstanceData() (*instanceDataSnapshot, error) {
+	return o.snap, nil
+}
+
+// overrideListing returns a line per override, in order of precedence,
+// marking those replaced by a later one.  Values of credentials and
+// secrets are left out.
+func overrideListing(overrides []instanceDataOverride) []string {
+	lines := make([]string, len(overrides))
+	for i, o := range overrides {
+		value := o.value
+		if lower := strings.ToLower(o.key); strings.Contains(lower, "credentials") ||
+			strings.Contains(lower, "secret") {
+			value = "(redacted)"
+		}
+		line := fmt.Sprintf("%s=%s (%s)", o.name, value, o.source)
+		for _, later := range overrides[i+1:] {
+			if canonicalIMDSSetting(later.key) == canonicalIMDSSetting(o.key) {
+				line += ", overridden by " + later.name
+				break
+			}
+		}
+		lines[i] = line
+	}
+	return lines
+}
+
+// logOverrides logs the active overrides at startup.
+func logOverrides(overrides []instanceDataOverride) {
+	for _, line := range overrideListing(overrides) {
+		klog.Infof("instance data override: %s", line)
+	}
+}
+
+// overridesDebugHandler lists the kernel command line and environment
+// overrides in effect.
+func (s *Server) overridesDebugHandler(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintf(w, "%s", strings.Join(overrideListing(s.overrides), "\n"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitCmdline(t *testing.T) {
+	got := splitCmdline("BOOT_IMAGE=/vmlinuz ro imds.tag.Name=\"web server\" \"imds.az=lab-1a\"\n")
+	want := []string{"BOOT_IMAGE=/vmlinuz", "ro", "imds.tag.Name=web server", "imds.az=lab-1a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	cmdline := filepath.Join(t.TempDir(), "cmdline")
+	if err := os.WriteFile(cmdline,
+		[]byte("quiet imds.instance_type=m5.large imds.az=lab-1a imds.tag.Team=infra\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := readOverrides(cmdline, []string{
+		"PATH=/usr/bin",
+		"IMDS_AVAILABILITY_ZONE=lab-1b",
+		"IMDS_TAG_Env=lab",
+		"IMDS_DS__META_DATA__IAM__CREDENTIALS__SECRETACCESSKEY=hunter2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := baseTestData()
+	l := &layeredInstanceData{layers: []instanceDataLayer{
+		{name: "cloud-init", source: &mockInstanceData{data: data}},
+		{name: "overrides", source: newOverrideInstanceData(overrides)},
+	}}
+	s := newTestServer(t, data)
+	s.dataSource = l
+	s.overrides = overrides
+	s.options.DebugOverrides = true
+
+	md, err := s.getMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The region of the layers below is kept.
+	if md.DS.InstanceType != "m5.large" || md.V1.AvailabilityZone != "lab-1b" || md.V1.Region != "us-west-2" {
+		t.Errorf("expected overrides to take precedence, got %+v %+v", md.V1, md.DS)
+	}
+	if md.DS.Tags["Team"] != "infra" || md.DS.Tags["Env"] != "lab" || md.DS.Tags["Name"] != "test-instance" {
+		t.Errorf("expected tags to be merged, got %v", md.DS.Tags)
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/overrides", nil))
+	want := "imds.instance_type=m5.large (kernel command line)\n" +
+		"imds.az=lab-1a (kernel command line), overridden by IMDS_AVAILABILITY_ZONE\n" +
+		"imds.tag.Team=infra (kernel command line)\n" +
+		"IMDS_AVAILABILITY_ZONE=lab-1b (environment)\n" +
+		"IMDS_TAG_Env=lab (environment)\n" +
+		"IMDS_DS__META_DATA__IAM__CREDENTIALS__SECRETACCESSKEY=(redacted) (environment)"
+	if w.Body.String() != want {
+		t.Errorf("expected listing\n%s\ngot\n%s", want, w.Body.String())
+	}
+}
+
+func TestOverridesWithoutCmdline(t *testing.T) {
+	overrides, err := readOverrides(filepath.Join(t.TempDir(), "missing"), nil)
+	if err != nil || len(overrides) != 0 {
+		t.Errorf("expected no overrides, got %v, %v", overrides, err)
+	}
+}
+
+func TestOverridesListingDisabled(t *testing.T) {
+	s := newTestServer(t, baseTestData())
+	s.overrides = []instanceDataOverride{{name: "IMDS_AZ", key: "az", value: "lab-1a", source: overrideSourceEnv}}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/overrides", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without -debug-overrides, got %d", w.Code)
+	}
+}
+
+func TestOverridesEnvironmentCase(t *testing.T) {
+	overrides, err := readOverrides("", []string{
+		"IMDS_V1__DISTRO=debian",
+		"IMDS_DS__META_DATA__IAM__CREDENTIALS__AccessKeyId=AKIDLAB",
+		"IMDS_TAG_Team=infra",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range overrides {
+		keys = append(keys, o.key)
+	}
+	want := []string{"v1.distro", "ds.meta_data.iam.credentials.AccessKeyId", "tag.Team"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected keys %q, got %q", want, keys)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// peerInfo describes the local process on the client side of a connection.
+type peerInfo struct {
+	UID   int
+	Inode uint64
+	// PID and Unit are only filled in when process details are requested,
+	// and are zero if the owning process could not be found.
+	PID  int
+	Unit string
+}
+
+// PeerResolver identifies the local process behind a client connection.
+type PeerResolver interface {
+	ResolvePeer(remoteAddr, localAddr string, withProcess bool) (*peerInfo, error)
+}
+
+// procPeerResolver resolves peers through procfs: the client socket is
+// looked up in /proc/net/tcp{,6} to find its owner UID and inode, and the
+// inode is then traced to a process and its systemd unit.
+//
+// Finding the process means reading every file descriptor in /proc, so
+// the owner of each socket is cached by inode, which stays the same for
+// all requests on a connection.
+type procPeerResolver struct {
+	root string
+
+	mu     sync.Mutex
+	owners map[uint64]int
+}
+
+// maxSocketOwners bounds the socket owner cache; it is cleared when full.
+const maxSocketOwners = 1024
+
+var errPeerNotFound = errors.New("client socket not found")
+
+func (r *procPeerResolver) ResolvePeer(
+	remoteAddr string,
+	localAddr string,
+	withProcess bool,
+) (*peerInfo, error) {
+	client, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	server, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var peer *peerInfo
+	for _, table := range []string{"net/tcp", "net/tcp6"} {
+		peer, err = findSocket(filepath.Join(r.root, table), client, server)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if peer != nil {
+			break
+		}
+	}
+	if peer == nil {
+		return nil, errPeerNotFound
+	}
+
+	if withProcess {
+		peer.PID = r.findSocketOwner(peer.Inode)
+		if peer.PID != 0 {
+			peer.Unit = r.systemdUnit(peer.PID)
+		}
+	}
+	return peer, nil
+}
+
+// findSocket scans a /proc/net/tcp-format table for the socket whose local
+// end is client and remote end is server.
+func findSocket(path string, client, server *net.TCPAddr) (*peerInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseProcNetAddr(fields[1])
+		if err != nil || !tcpAddrEqual(local, client) {
+			continue
+		}
+		remote, err := parseProcNetAddr(fields[2])
+		if err != nil || !tcpAddrEqual(remote, server) {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("bad uid in %s: %w", path, err)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad inode in %s: %w", path, err)
+		}
+		return &peerInfo{UID: uid, Inode: inode}, nil
+	}
+	return nil, scanner.Err()
+}
+
+// parseProcNetAddr parses an "ADDR:PORT" pair from /proc/net/tcp{,6}.  The
+// address is a sequence of 32-bit words in host (little-endian) byte order.
+func parseProcNetAddr(s string) (*net.TCPAddr, error) {
+	hexIP, hexPort, found := strings.Cut(s, ":")
+	if !found {
+		return nil, fmt.Errorf("malformed socket address %q", s)
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, fmt.Errorf("malformed socket address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed socket port %q", s)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func tcpAddrEqual(a, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// findSocketOwner returns the PID of a process holding the socket inode,
+// or 0 if none is found.  A cached owner is checked to still hold the
+// socket, as inodes are reused once sockets are closed.
+func (r *procPeerResolver) findSocketOwner(inode uint64) int {
+	target := fmt.Sprintf("socket:[%d]", inode)
+	r.mu.Lock()
+	pid, found := r.owners[inode]
+	r.mu.Unlock()
+	if found && r.holdsSocket(pid, target) {
+		return pid
+	}
+
+	pid = 0
+	procs, err := os.ReadDir(r.root)
+	if err != nil {
+		return 0
+	}
+	for _, p := range procs {
+		if n, err := strconv.Atoi(p.Name()); err == nil && r.holdsSocket(n, target) {
+			pid = n
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pid == 0 {
+		delete(r.owners, inode)
+		return 0
+	}
+	if r.owners == nil || len(r.owners) >= maxSocketOwners {
+		r.owners = make(map[uint64]int)
+	}
+	r.owners[inode] = pid
+	return pid
+}
+
+// holdsSocket reports whether process pid has a file descriptor for the
+// socket target, given as socket:[<inode>].
+func (r *procPeerResolver) holdsSocket(pid int, target string) bool {
+	fdDir := filepath.Join(r.root, strconv.Itoa(pid), "fd")
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err == nil && link == target {
+			return true
+		}
+	}
+	return false
+}
+
+// systemdUnit returns the systemd unit a process belongs to, taken from
+// the innermost unit-like element of its cgroup path.
+func (r *procPeerResolver) systemdUnit(pid int) string {
+	data, err := os.ReadFile(filepath.Join(r.root, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || (parts[0] != "0" && parts[1] != "name=systemd") {
+			continue
+		}
+		elems := strings.Split(parts[2], "/")
+		for i := len(elems) - 1; i >= 0; i-- {
+			if strings.HasSuffix(elems[i], ".service") ||
+				strings.HasSuffix(elems[i], ".scope") {
+				return elems[i]
+			}
+		}
+	}
+	return ""
+}
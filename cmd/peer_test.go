@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFakeProc builds a minimal procfs tree with one client socket
+// 127.0.0.1:43210 -> 169.254.169.254:80 owned by UID 1001 and PID 4242.
+func writeFakeProc(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	mustWrite := func(name, content string) {
+		t.Helper()
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	mustWrite("net/tcp", header+
+		"   0: 0100007F:A8CA FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000  1001        0 98765 1 0000000000000000 20 4 30 10 -1\n"+
+		"   1: FEA9FEA9:0050 0100007F:A8CA 01 00000000:00000000 00:00000000 00000000     0        0 98766 1 0000000000000000 20 4 30 10 -1\n")
+	mustWrite("net/tcp6", header)
+	mustWrite("4242/cgroup", "0::/system.slice/billing.service\n")
+	if err := os.MkdirAll(filepath.Join(root, "4242", "fd"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[98765]", filepath.Join(root, "4242", "fd", "3")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestProcPeerResolver(t *testing.T) {
+	r := &procPeerResolver{root: writeFakeProc(t)}
+
+	peer, err := r.ResolvePeer("127.0.0.1:43210", "169.254.169.254:80", true)
+	if err != nil {
+		t.Fatalf("ResolvePeer: %v", err)
+	}
+	if peer.UID != 1001 || peer.Inode != 98765 {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+	if peer.PID != 4242 || peer.Unit != "billing.service" {
+		t.Errorf("unexpected process details: %+v", peer)
+	}
+
+	if _, err := r.ResolvePeer("127.0.0.1:1", "169.254.169.254:80", false); err != errPeerNotFound {
+		t.Errorf("expected errPeerNotFound, got %v", err)
+	}
+}
+
+func TestProcPeerResolverOwnerCache(t *testing.T) {
+	root := writeFakeProc(t)
+	r := &procPeerResolver{root: root}
+	if pid := r.findSocketOwner(98765); pid != 4242 || r.owners[98765] != 4242 {
+		t.Fatalf("expected PID 4242 to be found and cached, got %d", pid)
+	}
+
+	// A socket that changed hands is looked up again.
+	if err := os.Rename(filepath.Join(root, "4242"), filepath.Join(root, "5151")); err != nil {
+		t.Fatal(err)
+	}
+	if pid := r.findSocketOwner(98765); pid != 5151 {
+		t.Errorf("expected the new owner 5151, got %d", pid)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "5151")); err != nil {
+		t.Fatal(err)
+	}
+	if pid := r.findSocketOwner(98765); pid != 0 {
+		t.Errorf("expected no owner, got %d", pid)
+	}
+	if _, found := r.owners[98765]; found {
+		t.Error("expected the stale owner to be dropped")
+	}
+}
+
+func TestParseProcNetAddrIPv6(t *testing.T) {
+	addr, err := parseProcNetAddr("0000000000000000FFFF00000100007F:0050")
+	if err != nil {
+		t.Fatalf("parseProcNetAddr: %v", err)
+	}
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) || addr.Port != 80 {
+		t.Errorf("unexpected address %v", addr)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// podIdentityCredentialsPath is where the EKS Pod Identity Agent
+	// serves credentials, at http://169.254.170.23/v1/credentials.
+	podIdentityCredentialsPath = "/v1/credentials"
+
+	defaultPodIdentityAudience = "pods.eks.amazonaws.com"
+
+	serviceAccountUserPrefix = "system:serviceaccount:"
+
+	// tokenReviewCacheTTL bounds how long a successful TokenReview is
+	// reused, so that revoked tokens are refused soon after.
+	tokenReviewCacheTTL = time.Minute
+)
+
+// podIdentityAssociations is the format of the association table mapping
+// service accounts to roles.
+type podIdentityAssociations struct {
+	Associations []podIdentityAssociation `json:"associations"`
+}
+
+type podIdentityAssociation struct {
+	Namespace      string `json:"namespace"`
+	ServiceAccount string `json:"service_account"`
+	RoleArn        string `json:"role_arn"`
+}
+
+// TokenValidator authenticates a projected service account token and
+// returns the namespace and name of its service account.
+type TokenValidator interface {
+	ValidateToken(token string) (namespace, serviceAccount string, err error)
+}
+
+// errTokenRejected is returned by a TokenValidator for tokens that are not
+// valid, as opposed to failures to validate them.
+var errTokenRejected = errors.New("service account token rejected")
+
+// podIdentityAgent serves credentials to pods by service account, like the
+// EKS Pod Identity Agent.
+type podIdentityAgent struct {
+	server      *Server
+	tokens      TokenValidator
+	clusterName string
+	roles       map[string]string
+}
+
+func newPodIdentityAgent(s *Server, tokens TokenValidator) (*podIdentityAgent, error) {
+	if s.options.PodIdentityAssociationsFile == "" {
+		return nil, errors.New(
+			"-pod-identity-listen requires -pod-identity-associations-file")
+	}
+	data, err := os.ReadFile(s.options.PodIdentityAssociationsFile)
+	if err != nil {
+		return nil, err
+	}
+	var table podIdentityAssociations
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("cannot parse pod identity associations %s: %w",
+			s.options.PodIdentityAssociationsFile, err)
+	}
+
+	roles := make(map[string]string, len(table.Associations))
+	for i, a := range table.Associations {
+		if a.Namespace == "" || a.ServiceAccount == "" || a.RoleArn == "" {
+			return nil, fmt.Errorf(
+				"pod identity associations %s: entry %d: namespace, service_account and role_arn are required",
+				s.options.PodIdentityAssociationsFile, i)
+		}
+		roles[a.Namespace+"/"+a.ServiceAccount] = a.RoleArn
+	}
+
+	return &podIdentityAgent{
+		server:      s,
+		tokens:      tokens,
+		clusterName: s.options.PodIdentityClusterName,
+		roles:       roles,
+	}, nil
+}
+
+// Handler returns an http.Handler serving the Pod Identity Agent
+// credentials endpoint.
+func (a *podIdentityAgent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(podIdentityCredentialsPath, a.server.auditCredentials(
+		"Authorization", http.HandlerFunc(a.credentialsHandler)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		klog.V(5).Infof("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeContainerError(w, http.StatusMethodNotAllowed,
+				"MethodNotAllowed", "only GET is supported")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (a *podIdentityAgent) credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		writeContainerError(w, http.StatusBadRequest,
+			"InvalidTokenException", "service account token is required")
+		return
+	}
+
+	namespace, serviceAccount, err := a.tokens.ValidateToken(token)
+	if errors.Is(err, errTokenRejected) {
+		writeContainerError(w, http.StatusUnauthorized,
+			"InvalidTokenException", err.Error())
+		return
+	}
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+
+	auditRecordFrom(r).setSubject(namespace + "/" + serviceAccount)
+
+	roleArn, ok := a.roles[namespace+"/"+serviceAccount]
+	if !ok {
+		writeContainerError(w, http.StatusForbidden, "AccessDeniedException",
+			fmt.Sprintf("no pod identity association for %s/%s", namespace, serviceAccount))
+		return
+	}
+
+	auditRecordFrom(r).setRole(&servedRole{name: roleNameFromArn(roleArn), arn: roleArn})
+
+	tags := map[string]string{
+		"kubernetes-namespace":       namespace,
+		"kubernetes-service-account": serviceAccount,
+	}
+	if a.clusterName != "" {
+		tags["eks-cluster-name"] = a.clusterName
+	}
+	imdsCreds, err := a.server.roleCache.getTagged(roleArn, tags)
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+
+	data, err := json.MarshalIndent(containerCredentials{
+		AccessKeyID:     imdsCreds.AccessKeyID,
+		SecretAccessKey: imdsCreds.SecretAccessKey,
+		Token:           imdsCreds.Token,
+		Expiration:      imdsCreds.Expiration,
+		RoleArn:         roleArn,
+	}, "", "  ")
+	if err != nil {
+		writeContainerError(w, http.StatusInternalServerError,
+			"InternalError", err.Error())
+		return
+	}
+	auditRecordFrom(r).setAccessKeyID(imdsCreds.AccessKeyID)
+	fmt.Fprintf(w, "%s", data)
+}
+
+// kubeTokenReviewer validates service account tokens with the Kubernetes
+// TokenReview API.  Tokens it accepted are not reviewed again until they
+// expire or for tokenReviewCacheTTL, whichever is sooner.
+type kubeTokenReviewer struct {
+	kube     *kubeClient
+	audience string
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]tokenReviewCacheEntry
+}
+
+type tokenReviewCacheEntry struct {
+	namespace      string
+	serviceAccount string
+	expires        time.Time
+}
+
+func newKubeTokenReviewer(kube *kubeClient, audience string) *kubeTokenReviewer {
+	return &kubeTokenReviewer{
+		kube:     kube,
+		audience: audience,
+		now:      time.Now,
+		cache:    make(map[[sha256.Size]byte]tokenReviewCacheEntry),
+	}
+}
+
+// kubeTokenReview is the subset of an authentication.k8s.io/v1
+// TokenReview used here.
+type kubeTokenReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Authenticated bool `json:"authenticated"`
+		User          struct {
+			Username string `json:"username"`
+		} `json:"user"`
+		Error string `json:"error"`
+	} `json:"status"`
+}
+
+func (k *kubeTokenReviewer) ValidateToken(token string) (string, string, error) {
+	// Tokens are kept hashed, so that the cache holds no credentials.
+	key := sha256.Sum256([]byte(token))
+	k.mu.Lock()
+	entry, ok := k.cache[key]
+	k.mu.Unlock()
+	if ok && k.now().Before(entry.expires) {
+		return entry.namespace, entry.serviceAccount, nil
+	}
+
+	namespace, serviceAccount, err := k.review(token)
+	if err != nil {
+		return "", "", err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	for key, e := range k.cache {
+		if !now.Before(e.expires) {
+			delete(k.cache, key)
+		}
+	}
+	expires := now.Add(tokenReviewCacheTTL)
+	if exp, ok := tokenExpiry(token); ok && exp.Before(expires) {
+		expires = exp
+	}
+	k.cache[key] = tokenReviewCacheEntry{
+		namespace:      namespace,
+		serviceAccount: serviceAccount,
+		expires:        expires,
+	}
+	return namespace, serviceAccount, nil
+}
+
+// tokenExpiry returns the exp claim of a JWT.  The token is not verified,
+// which is fine only for tokens the API server has accepted.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// review validates token with a TokenReview.
+func (k *kubeTokenReviewer) review(token string) (string, string, error) {
+	review := kubeTokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+	}
+	review.Spec.Token = token
+	if k.audience != "" {
+		review.Spec.Audiences = []string{k.audience}
+	}
+
+	var result kubeTokenReview
+	err := k.kube.do(http.MethodPost,
+		"/apis/authentication.k8s.io/v1/tokenreviews", &review, &result)
+	if err != nil {
+		return "", "", err
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			return "", "", fmt.Errorf("%w: %s", errTokenRejected, result.Status.Error)
+		}
+		return "", "", errTokenRejected
+	}
+
+	user := result.Status.User.Username
+	parts := strings.Split(strings.TrimPrefix(user, serviceAccountUserPrefix), ":")
+	if !strings.HasPrefix(user, serviceAccountUserPrefix) || len(parts) != 2 {
+		return "", "", fmt.Errorf("%w: %q is not a service account", errTokenRejected, user)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockTokenValidator accepts fixed tokens.
+type mockTokenValidator struct {
+	tokens map[string][2]string
+}
+
+func (m *mockTokenValidator) ValidateToken(token string) (string, string, error) {
+	sa, ok := m.tokens[token]
+	if !ok {
+		return "", "", errTokenRejected
+	}
+	return sa[0], sa[1], nil
+}
+
+func newPodIdentityTestAgent(t *testing.T) (*podIdentityAgent, *[]string) {
+	t.Helper()
+	var (
+		mu   sync.Mutex
+		tags []string
+	)
+	offline := newOfflineSTS("123456789012", time.Hour).Handler()
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err == nil {
+			mu.Lock()
+			for i := 1; r.PostForm.Get(tagKey(i)) != ""; i++ {
+				tags = append(tags, r.PostForm.Get(tagKey(i))+"="+r.PostForm.Get(tagValue(i)))
+			}
+			mu.Unlock()
+		}
+		offline.ServeHTTP(w, r)
+	}))
+	t.Cleanup(sts.Close)
+
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["services"] = map[string]interface{}{
+		"endpoints": map[string]interface{}{"sts": sts.URL},
+	}
+	s := newTestServerWithIAM(t, data)
+
+	path := filepath.Join(t.TempDir(), "associations.json")
+	err := os.WriteFile(path, []byte(`{"associations": [
+		{"namespace": "shop", "service_account": "api", "role_arn": "arn:aws:iam::123456789012:role/shop-api"}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.options.PodIdentityAssociationsFile = path
+	s.options.PodIdentityClusterName = "vm-cluster"
+
+	agent, err := newPodIdentityAgent(s, &mockTokenValidator{tokens: map[string][2]string{
+		"api-token":   {"shop", "api"},
+		"other-token": {"shop", "worker"},
+	}})
+	if err != nil {
+		t.Fatalf("newPodIdentityAgent: %v", err)
+	}
+	return agent, &tags
+}
+
+func tagKey(i int) string   { return fmt.Sprintf("Tags.member.%d.Key", i) }
+func tagValue(i int) string { return fmt.Sprintf("Tags.member.%d.Value", i) }
+
+func TestPodIdentityCredentials(t *testing.T) {
+	agent, tags := newPodIdentityTestAgent(t)
+
+	req := httptest.NewRequest("GET", podIdentityCredentialsPath, nil)
+	req.Header.Set("Authorization", "api-token")
+	w := httptest.NewRecorder()
+	agent.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var creds containerCredentials
+	if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if creds.RoleArn != "arn:aws:iam::123456789012:role/shop-api" ||
+		creds.AccessKeyID == "AKIATEST" || creds.Token == "" {
+		t.Errorf("expected assumed-role credentials, got %+v", creds)
+	}
+
+	want := []string{
+		"eks-cluster-name=vm-cluster",
+		"kubernetes-namespace=shop",
+		"kubernetes-service-account=api",
+	}
+	if len(*tags) != len(want) {
+		t.Fatalf("expected session tags %v, got %v", want, *tags)
+	}
+	for i := range want {
+		if (*tags)[i] != want[i] {
+			t.Errorf("expected session tags %v, got %v", want, *tags)
+			break
+		}
+	}
+}
+
+func TestPodIdentityRejects(t *testing.T) {
+	agent, _ := newPodIdentityTestAgent(t)
+
+	tests := []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusBadRequest},
+		{"forged", http.StatusUnauthorized},
+		{"other-token", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", podIdentityCredentialsPath, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", tt.token)
+		}
+		w := httptest.NewRecorder()
+		agent.Handler().ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("token %q: expected %d, got %d", tt.token, tt.code, w.Code)
+		}
+	}
+}
+
+func TestKubeTokenReviewer(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var review kubeTokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			t.Fatalf("bad TokenReview: %v", err)
+		}
+		if len(review.Spec.Audiences) != 1 || review.Spec.Audiences[0] != defaultPodIdentityAudience {
+			t.Errorf("unexpected audiences %v", review.Spec.Audiences)
+		}
+		switch review.Spec.Token {
+		case "good":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:shop:api"
+		case "user":
+			review.Status.Authenticated = true
+			review.Status.User.Username = "alice"
+		default:
+			review.Status.Error = "invalid bearer token"
+		}
+		json.NewEncoder(w).Encode(&review)
+	}))
+	defer api.Close()
+
+	kube, err := newKubeClient(&Options{KubeAPIServer: api.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newKubeTokenReviewer(kube, defaultPodIdentityAudience)
+
+	ns, sa, err := v.ValidateToken("good")
+	if err != nil || ns != "shop" || sa != "api" {
+		t.Errorf("expected shop/api, got %s/%s (%v)", ns, sa, err)
+	}
+	for _, token := range []string{"user", "bad"} {
+		if _, _, err := v.ValidateToken(token); !errors.Is(err, errTokenRejected) {
+			t.Errorf("expected %q to be rejected", token)
+		}
+	}
+}
+
+func TestKubeTokenReviewerCache(t *testing.T) {
+	var reviews int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reviews, 1)
+		var review kubeTokenReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			t.Fatalf("bad TokenReview: %v", err)
+		}
+		if review.Spec.Token != "bad" {
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:shop:api"
+		}
+		json.NewEncoder(w).Encode(&review)
+	}))
+	defer api.Close()
+
+	kube, err := newKubeClient(&Options{KubeAPIServer: api.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	v := newKubeTokenReviewer(kube, defaultPodIdentityAudience)
+	v.now = func() time.Time { return now }
+
+	validate := func(token string, wantReviews int32) {
+		t.Helper()
+		if ns, sa, err := v.ValidateToken(token); err != nil || ns != "shop" || sa != "api" {
+			t.Fatalf("expected shop/api, got %s/%s (%v)", ns, sa, err)
+		}
+		if got := atomic.LoadInt32(&reviews); got != wantReviews {
+			t.Fatalf("expected %d TokenReviews, got %d", wantReviews, got)
+		}
+	}
+
+	// A token without an expiry is reused for tokenReviewCacheTTL.
+	validate("opaque", 1)
+	validate("opaque", 1)
+	now = now.Add(tokenReviewCacheTTL)
+	validate("opaque", 2)
+
+	// A JWT is not reused past its exp claim.
+	claims := base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf(`{"exp": %d}`, now.Add(10*time.Second).Unix())))
+	jwt := "eyJhbGciOiJSUzI1NiJ9." + claims + ".c2ln"
+	validate(jwt, 3)
+	now = now.Add(5 * time.Second)
+	validate(jwt, 3)
+	now = now.Add(5 * time.Second)
+	validate(jwt, 4)
+
+	// Rejections are not cached.
+	for i := 0; i < 2; i++ {
+		if _, _, err := v.ValidateToken("bad"); !errors.Is(err, errTokenRejected) {
+			t.Fatalf("expected rejection, got %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&reviews); got != 6 {
+		t.Errorf("expected rejected tokens to be reviewed every time, got %d reviews", got)
+	}
+}
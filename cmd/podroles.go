@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"k8s.io/klog/v2"
+)
+
+// podIdentity is a pod or container identified by its IP address.
+type podIdentity struct {
+	Namespace string
+	Name      string
+	// Role is the ARN of the pod's role.
+	Role string
+}
+
+// PodResolver maps a client IP address to the pod or container using it.
+// It returns nil if the address does not belong to a known pod.
+type PodResolver interface {
+	ResolvePod(ip net.IP) (*podIdentity, error)
+}
+
+// podRoleResolver is a RoleResolver serving each pod the role its
+// PodResolver reports, kube2iam-style.
+type podRoleResolver struct {
+	pods     PodResolver
+	fallback fallbackRole
+}
+
+func (p *podRoleResolver) ResolveRole(s *Server, r *http.Request) (*servedRole, error) {
+	// Clients on the unix socket have no IP address, and are no pod.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return p.fallback.resolve(s)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return p.fallback.resolve(s)
+	}
+
+	pod, err := p.pods.ResolvePod(ip)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve pod for %s: %w", ip, err)
+	}
+	if pod == nil || pod.Role == "" {
+		return p.fallback.resolve(s)
+	}
+
+	// A bare role name could only be qualified with -account-id, which
+	// defaults to a placeholder, so roles must be given as ARNs.
+	if !arn.IsARN(pod.Role) {
+		return nil, fmt.Errorf("role %q of pod %s/%s is not an ARN", pod.Role, pod.Namespace, pod.Name)
+	}
+	return &servedRole{name: roleNameFromArn(pod.Role), arn: pod.Role}, nil
+}
+
+// filePodResolver resolves pods from a JSON mapping file, which is
+// reloaded whenever it changes.  A version that cannot be read or parsed
+// leaves the previous one in use.
+type filePodResolver struct {
+	path string
+
+	mu      sync.Mutex
+	stamp   fileStamp
+	entries []podMappingEntry
+	err     error
+}
+
+// podMappingFile is the format of the file read by filePodResolver.
+type podMappingFile struct {
+	Pods []podMappingEntry `json:"pods"`
+}
+
+// podMappingEntry maps an IP address or CIDR block to a pod and its role.
+type podMappingEntry struct {
+	IP        string `json:"ip,omitempty"`
+	CIDR      string `json:"cidr,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Role      string `json:"role"`
+
+	network *net.IPNet
+}
+
+func (f *filePodResolver) ResolvePod(ip net.IP) (*podIdentity, error) {
+	entries, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.network.Contains(ip) {
+			return &podIdentity{Namespace: e.Namespace, Name: e.Name, Role: e.Role}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *filePodResolver) load() ([]podMappingEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stamp := stampFile(f.path)
+	if stamp == f.stamp {
+		return f.entries, f.err
+	}
+	// Recorded even on failure, so a broken file is parsed only once.
+	f.stamp = stamp
+
+	entries, err := f.parse()
+	if err != nil {
+		if f.entries != nil {
+			klog.Warningf("keeping previous pod mapping: %v", err)
+			return f.entries, nil
+		}
+		f.err = err
+		return nil, err
+	}
+	f.entries, f.err = entries, nil
+	return entries, nil
+}
+
+func (f *filePodResolver) parse() ([]podMappingEntry, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var file podMappingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("cannot parse pod mapping %s: %w", f.path, err)
+	}
+
+	entries := make([]podMappingEntry, 0, len(file.Pods))
+	for i, e := range file.Pods {
+		cidr := e.CIDR
+		if e.IP != "" {
+			ip := net.ParseIP(e.IP)
+			if ip == nil {
+				return nil, fmt.Errorf("pod mapping %s: entry %d: invalid ip %q", f.path, i, e.IP)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			cidr = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("pod mapping %s: entry %d: %w", f.path, i, err)
+		}
+		e.network = network
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
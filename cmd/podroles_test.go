@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFilePodResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pods.json")
+	err := os.WriteFile(path, []byte(`{"pods": [
+		{"ip": "10.244.1.7", "namespace": "web", "name": "frontend", "role": "frontend"},
+		{"cidr": "10.244.2.0/24", "role": "arn:aws:iam::210987654321:role/batch"}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &filePodResolver{path: path}
+
+	pod, err := r.ResolvePod(net.ParseIP("10.244.1.7"))
+	if err != nil || pod == nil || pod.Name != "frontend" || pod.Role != "frontend" {
+		t.Errorf("unexpected pod %+v (%v)", pod, err)
+	}
+	pod, err = r.ResolvePod(net.ParseIP("10.244.2.33"))
+	if err != nil || pod == nil || pod.Role != "arn:aws:iam::210987654321:role/batch" {
+		t.Errorf("unexpected pod %+v (%v)", pod, err)
+	}
+	if pod, _ := r.ResolvePod(net.ParseIP("10.244.3.1")); pod != nil {
+		t.Errorf("expected no pod, got %+v", pod)
+	}
+
+	// The file is reloaded when it changes.
+	err = os.WriteFile(path, []byte(`{"pods": [{"ip": "10.244.3.1", "role": "late"}]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if pod, _ := r.ResolvePod(net.ParseIP("10.244.3.1")); pod == nil || pod.Role != "late" {
+		t.Errorf("expected reloaded mapping, got %+v", pod)
+	}
+
+	// A version that cannot be parsed leaves the previous one in use.
+	if err := os.WriteFile(path, []byte(`{"pods": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	pod, err = r.ResolvePod(net.ParseIP("10.244.3.1"))
+	if err != nil || pod == nil || pod.Role != "late" {
+		t.Errorf("expected previous mapping, got %+v (%v)", pod, err)
+	}
+	if r.stamp != stampFile(path) {
+		t.Error("expected the broken version to be recorded")
+	}
+}
+
+func TestFilePodResolverInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pods.json")
+	if err := os.WriteFile(path, []byte(`{"pods": [{"ip": "10.244.1"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := &filePodResolver{path: path}
+	if _, err := r.ResolvePod(net.ParseIP("10.244.1.7")); err == nil {
+		t.Error("expected error for invalid mapping")
+	}
+	if _, err := r.ResolvePod(net.ParseIP("10.244.1.7")); err == nil {
+		t.Error("expected the error to be kept until the file changes")
+	}
+}
+
+func TestPodRoleResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pods.json")
+	err := os.WriteFile(path, []byte(`{"pods": [
+		{"ip": "10.244.1.7", "role": "arn:aws:iam::210987654321:role/frontend"},
+		{"ip": "10.244.1.8", "namespace": "web", "name": "legacy", "role": "legacy"}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServerWithIAM(t, baseTestData())
+	s.roleResolver = &podRoleResolver{pods: &filePodResolver{path: path}}
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials", nil)
+	req.RemoteAddr = "10.244.1.7:51000"
+	role, err := s.resolveRole(req)
+	if err != nil {
+		t.Fatalf("resolveRole: %v", err)
+	}
+	if role.name != "frontend" || role.arn != "arn:aws:iam::210987654321:role/frontend" {
+		t.Errorf("unexpected role %+v", role)
+	}
+
+	// Bare role names are not qualified with the placeholder account.
+	req.RemoteAddr = "10.244.1.8:51000"
+	if role, err := s.resolveRole(req); err == nil {
+		t.Errorf("expected error for bare role name, got %+v", role)
+	}
+
+	req.RemoteAddr = "10.244.9.9:51000"
+	w := httptest.NewRecorder()
+	s.iamSecurityCredentialsListHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown pod, got %d", w.Code)
+	}
+}
+
+func TestKubePodResolver(t *testing.T) {
+	var calls int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if got := r.URL.Query().Get("fieldSelector"); got != "status.podIP=10.244.1.7,spec.nodeName=node-1" {
+			t.Errorf("unexpected fieldSelector %q", got)
+		}
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			t.Errorf("unexpected Authorization %q", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"items": [
+			{"metadata": {"name": "node-agent", "namespace": "kube-system",
+			  "annotations": {"iam.amazonaws.com/role": "node-admin"}},
+			 "spec": {"hostNetwork": true}, "status": {"phase": "Running"}},
+			{"metadata": {"name": "api-0", "namespace": "shop",
+			  "annotations": {"iam.amazonaws.com/role": "shop-api"}},
+			 "spec": {}, "status": {"phase": "Running"}}
+		]}`))
+	}))
+	defer api.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("sa-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newKubePodResolver(&Options{
+		KubeAPIServer: api.URL,
+		KubeTokenFile: tokenFile,
+		KubeNodeName:  "node-1",
+	})
+	if err != nil {
+		t.Fatalf("newKubePodResolver: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		pod, err := r.ResolvePod(net.ParseIP("10.244.1.7"))
+		if err != nil {
+			t.Fatalf("ResolvePod: %v", err)
+		}
+		if pod == nil || pod.Name != "api-0" || pod.Role != "shop-api" {
+			t.Errorf("unexpected pod %+v", pod)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected cached lookup, got %d API calls", n)
+	}
+}
+
+func TestPodRoleResolverUnixSocket(t *testing.T) {
+	s := newTestServerWithIAM(t, baseTestData())
+	s.roleResolver = &podRoleResolver{
+		pods:     &filePodResolver{path: filepath.Join(t.TempDir(), "pods.json")},
+		fallback: fallbackRole{instance: true},
+	}
+	path := filepath.Join(t.TempDir(), "imds.sock")
+	l, err := listenUnix(path, 0o600, -1)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	srv := &http.Server{Handler: s.Handler()}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c := newIMDSClient("", path)
+	token, err := c.do("PUT", "/latest/api/token", "")
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	roles, err := c.do("GET", "/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		t.Fatalf("expected the fallback role, got %v", err)
+	}
+	if roles != "test-role" {
+		t.Errorf("expected the instance role, got %q", roles)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // SSO token cache key, not a security boundary
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+)
+
+const (
+	ssoSessionProvName = "SSOSessionProvider"
+
+	// maxProfileChainDepth bounds source_profile recursion.
+	maxProfileChainDepth = 16
+)
+
+// iniFile is a parsed INI file: section name to key/value pairs.
+type iniFile map[string]map[string]string
+
+// loadINIFile parses an AWS shared config or credentials file.  Nested
+// sub-sections (indented keys, as used by s3 settings) are folded into their
+// parent key and otherwise ignored.
+func loadINIFile(path string) (iniFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make(iniFile)
+	var section map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			section = result[name]
+			if section == nil {
+				section = make(map[string]string)
+				result[name] = section
+			}
+			continue
+		}
+		if section == nil || raw[0] == ' ' || raw[0] == '\t' {
+			continue
+		}
+		key, val, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		section[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// profile returns the named profile from a shared config file.
+func (f iniFile) profile(name string) (map[string]string, bool) {
+	if name == "default" {
+		if p, ok := f["default"]; ok {
+			return p, true
+		}
+	}
+	p, ok := f["profile "+name]
+	return p, ok
+}
+
+// profileCredentialSource resolves credentials for a named profile of the
+// AWS shared configuration.
+type profileCredentialSource struct {
+	server          *Server
+	config          iniFile
+	configFile      string
+	credentialsFile string
+	ssoCacheDir     string
+}
+
+func (s *Server) newProfileCredentialSource() (*profileCredentialSource, error) {
+	home, _ := os.UserHomeDir()
+	src := &profileCredentialSource{
+		server:          s,
+		configFile:      s.options.AWSConfigFile,
+		credentialsFile: s.options.AWSCredentialsFile,
+		ssoCacheDir:     s.options.AWSSSOCacheDir,
+	}
+	if src.configFile == "" {
+		src.configFile = filepath.Join(home, ".aws", "config")
+	}
+	if src.credentialsFile == "" {
+		src.credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	if src.ssoCacheDir == "" {
+		src.ssoCacheDir = filepath.Join(home, ".aws", "sso", "cache")
+	}
+
+	config, err := loadINIFile(src.configFile)
+	if err != nil {
+		return nil, err
+	}
+	src.config = config
+	return src, nil
+}
+
+// roleFor returns the ARN and name of the role a profile ends up with.
+func (p *profileCredentialSource) roleFor(name string) (string, string) {
+	prof, _ := p.config.profile(name)
+	if prof["role_arn"] != "" {
+		return prof["role_arn"], ""
+	}
+	if prof["sso_role_name"] != "" {
+		return "", prof["sso_role_name"]
+	}
+	return "", name
+}
+
+// credentials returns credentials for the named profile.  Role chains are
+// resolved here so that any profile in the chain may use an sso_session;
+// every other kind of profile is handled by the SDK.
+func (p *profileCredentialSource) credentials(name string, depth int) (*credentials.Credentials, error) {
+	if depth > maxProfileChainDepth {
+		return nil, fmt.Errorf("profile %q: source_profile chain is too long", name)
+	}
+
+	prof, ok := p.config.profile(name)
+	if !ok {
+		// The profile may only exist in the credentials file.
+		return p.sdkCredentials(name)
+	}
+
+	if prof["role_arn"] != "" && prof["source_profile"] != "" &&
+		prof["source_profile"] != name {
+		base, err := p.credentials(prof["source_profile"], depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return p.assumeRole(prof, base)
+	}
+
+	if prof["sso_session"] != "" {
+		return p.ssoSessionCredentials(name, prof)
+	}
+
+	return p.sdkCredentials(name)
+}
+
+func (p *profileCredentialSource) sdkCredentials(name string) (*credentials.Credentials, error) {
+	config, err := p.server.applyEndpointOptions(aws.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           name,
+		SharedConfigState: session.SharedConfigEnable,
+		SharedConfigFiles: []string{p.credentialsFile, p.configFile},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+	return sess.Config.Credentials, nil
+}
+
+func (p *profileCredentialSource) awsConfig(
+	prof map[string]string,
+	creds *credentials.Credentials,
+) (*aws.Config, error) {
+	config, err := p.server.getAWSConfig(creds)
+	if err != nil {
+		return nil, err
+	}
+	if prof["region"] != "" {
+		config = config.WithRegion(prof["region"])
+	}
+	return config, nil
+}
+
+func (p *profileCredentialSource) assumeRole(
+	prof map[string]string,
+	base *credentials.Credentials,
+) (*credentials.Credentials, error) {
+	config, err := p.awsConfig(prof, base)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create AWS session: %w", err)
+	}
+
+	return stscreds.NewCredentials(sess, prof["role_arn"],
+		func(arp *stscreds.AssumeRoleProvider) {
+			if v := prof["role_session_name"]; v != "" {
+				arp.RoleSessionName = v
+			}
+			if v := prof["external_id"]; v != "" {
+				arp.ExternalID = aws.String(v)
+			}
+			if v := prof["duration_seconds"]; v != "" {
+				if secs, err := strconv.Atoi(v); err == nil {
+					arp.Duration = time.Duration(secs) * time.Second
+				}
+			}
+		}), nil
+}
+
+func (p *profileCredentialSource) ssoSessionCredentials(
+	name string,
+	prof map[string]string,
+) (*credentials.Credentials, error) {
+	sessionName := prof["sso_session"]
+	ssoSession, ok := p.config["sso-session "+sessionName]
+	if !ok {
+		return nil, fmt.Errorf(
+			"profile %q: sso-session %q not found in %s",
+			name, sessionName, p.configFile)
+	}
+	if prof["sso_account_id"] == "" || prof["sso_role_name"] == "" {
+		return nil, fmt.Errorf(
+			"profile %q: sso_account_id and sso_role_name are required", name)
+	}
+
+	region := ssoSession["sso_region"]
+	if region == "" {
+		region = prof["sso_region"]
+	}
+	config, err := p.server.applyEndpointOptions(aws.NewConfig().
+		WithRegion(region).
+		WithCredentials(credentials.AnonymousCredentials))
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create AWS session: %w", err)
+	}
+
+	return credentials.NewCredentials(&ssoSessionProvider{
+		client:    sso.New(sess),
+		cacheFile: ssoTokenCacheFile(p.ssoCacheDir, sessionName),
+		accountID: prof["sso_account_id"],
+		roleName:  prof["sso_role_name"],
+	}), nil
+}
+
+// ssoTokenCacheFile returns the path of the cached SSO token for an
+// sso-session, as written by `aws sso login`.
+func ssoTokenCacheFile(dir string, sessionName string) string {
+	sum := sha1.Sum([]byte(sessionName)) //nolint:gosec
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// ssoSessionProvider exchanges the cached token of an sso-session for role
+// credentials using the IAM Identity Center GetRoleCredentials API.
+type ssoSessionProvider struct {
+	credentials.Expiry
+
+	client    ssoiface.SSOAPI
+	cacheFile string
+	accountID string
+	roleName  string
+}
+
+// ssoCachedToken is the subset of the SSO token cache file used here.
+type ssoCachedToken struct {
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Retrieve reads the cached SSO token and calls GetRoleCredentials.
+func (p *ssoSessionProvider) Retrieve() (credentials.Value, error) {
+	data, err := os.ReadFile(p.cacheFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf(
+			"cannot read SSO token, run `aws sso login`: %w", err)
+	}
+	var token ssoCachedToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot parse SSO token cache: %w", err)
+	}
+	if token.AccessToken == "" {
+		return credentials.Value{}, errors.New("SSO token cache has no access token")
+	}
+	if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+		return credentials.Value{}, errors.New(
+			"cached SSO token has expired, run `aws sso login`")
+	}
+
+	out, err := p.client.GetRoleCredentials(&sso.GetRoleCredentialsInput{
+		AccessToken: aws.String(token.AccessToken),
+		AccountId:   aws.String(p.accountID),
+		RoleName:    aws.String(p.roleName),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	rc := out.RoleCredentials
+	p.SetExpiration(time.UnixMilli(aws.Int64Value(rc.Expiration)).UTC(), 0)
+	klog.Infof("obtained SSO credentials for %s in account %s", p.roleName, p.accountID)
+
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(rc.AccessKeyId),
+		SecretAccessKey: aws.StringValue(rc.SecretAccessKey),
+		SessionToken:    aws.StringValue(rc.SessionToken),
+		ProviderName:    ssoSessionProvName,
+	}, nil
+}
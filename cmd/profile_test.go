@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sso/ssoiface"
+)
+
+const testAWSConfig = `
+[default]
+region = us-west-2
+
+[profile static]
+aws_access_key_id = AKIASTATIC
+aws_secret_access_key = staticsecret
+
+[profile dev]
+sso_session = corp
+sso_account_id = 111122223333
+sso_role_name = Developer
+s3 =
+  max_concurrent_requests = 4
+
+[profile admin]
+role_arn = arn:aws:iam::111122223333:role/Admin
+source_profile = dev
+
+[sso-session corp]
+sso_region = us-east-1
+sso_start_url = https://corp.awsapps.com/start
+`
+
+// mockSSOClient returns fixed role credentials for a known token.
+type mockSSOClient struct {
+	ssoiface.SSOAPI
+	input *sso.GetRoleCredentialsInput
+}
+
+func (m *mockSSOClient) GetRoleCredentials(
+	in *sso.GetRoleCredentialsInput,
+) (*sso.GetRoleCredentialsOutput, error) {
+	m.input = in
+	return &sso.GetRoleCredentialsOutput{
+		RoleCredentials: &sso.RoleCredentials{
+			AccessKeyId:     aws.String("ASIASSO"),
+			SecretAccessKey: aws.String("ssosecret"),
+			SessionToken:    aws.String("ssotoken"),
+			Expiration:      aws.Int64(4070908800000),
+		},
+	}, nil
+}
+
+func newProfileTestSource(t *testing.T) *profileCredentialSource {
+	t.Helper()
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	if err := os.WriteFile(configFile, []byte(testAWSConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, baseTestData())
+	s.options.AWSConfigFile = configFile
+	s.options.AWSCredentialsFile = filepath.Join(dir, "credentials")
+	s.options.AWSSSOCacheDir = filepath.Join(dir, "sso")
+	src, err := s.newProfileCredentialSource()
+	if err != nil {
+		t.Fatalf("newProfileCredentialSource: %v", err)
+	}
+	return src
+}
+
+func TestLoadINIFile(t *testing.T) {
+	src := newProfileTestSource(t)
+
+	dev, ok := src.config.profile("dev")
+	if !ok {
+		t.Fatal("profile dev not found")
+	}
+	if dev["sso_session"] != "corp" || dev["sso_role_name"] != "Developer" {
+		t.Errorf("unexpected dev profile: %v", dev)
+	}
+	if _, ok := dev["max_concurrent_requests"]; ok {
+		t.Error("nested sub-section keys should be ignored")
+	}
+	if def, _ := src.config.profile("default"); def["region"] != "us-west-2" {
+		t.Errorf("unexpected default profile: %v", def)
+	}
+	if src.config["sso-session corp"]["sso_region"] != "us-east-1" {
+		t.Errorf("sso-session not parsed: %v", src.config)
+	}
+}
+
+func TestProfileStaticCredentials(t *testing.T) {
+	src := newProfileTestSource(t)
+
+	creds, err := src.credentials("static", 0)
+	if err != nil {
+		t.Fatalf("credentials: %v", err)
+	}
+	val, err := creds.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if val.AccessKeyID != "AKIASTATIC" {
+		t.Errorf("unexpected credentials: %+v", val)
+	}
+}
+
+func TestProfileRoleFor(t *testing.T) {
+	src := newProfileTestSource(t)
+
+	if arn, _ := src.roleFor("admin"); arn != "arn:aws:iam::111122223333:role/Admin" {
+		t.Errorf("unexpected admin role ARN %q", arn)
+	}
+	if _, name := src.roleFor("dev"); name != "Developer" {
+		t.Errorf("unexpected dev role name %q", name)
+	}
+}
+
+func TestSSOSessionProvider(t *testing.T) {
+	dir := t.TempDir()
+	cacheFile := ssoTokenCacheFile(dir, "corp")
+	token := `{"accessToken":"ssoaccess","expiresAt":"` +
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`
+	if err := os.WriteFile(cacheFile, []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &mockSSOClient{}
+	creds := credentials.NewCredentials(&ssoSessionProvider{
+		client:    client,
+		cacheFile: cacheFile,
+		accountID: "111122223333",
+		roleName:  "Developer",
+	})
+	val, err := creds.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if val.AccessKeyID != "ASIASSO" || val.SessionToken != "ssotoken" {
+		t.Errorf("unexpected credentials: %+v", val)
+	}
+	if aws.StringValue(client.input.AccessToken) != "ssoaccess" ||
+		aws.StringValue(client.input.RoleName) != "Developer" {
+		t.Errorf("unexpected GetRoleCredentials input: %v", client.input)
+	}
+	if expiresAt, _ := creds.ExpiresAt(); expiresAt.Year() != 2099 {
+		t.Errorf("unexpected expiry %v", expiresAt)
+	}
+}
+
+func TestSSOSessionProviderExpiredToken(t *testing.T) {
+	dir := t.TempDir()
+	cacheFile := ssoTokenCacheFile(dir, "corp")
+	token := `{"accessToken":"ssoaccess","expiresAt":"2000-01-01T00:00:00Z"}`
+	if err := os.WriteFile(cacheFile, []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := credentials.NewCredentials(&ssoSessionProvider{
+		client:    &mockSSOClient{},
+		cacheFile: cacheFile,
+	})
+	if _, err := creds.Get(); err == nil {
+		t.Error("expected error for expired SSO token")
+	}
+}
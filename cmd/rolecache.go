@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// servedRole is the role a particular request is entitled to.
+type servedRole struct {
+	// name is listed under iam/security-credentials/.
+	name string
+	// arn is the role assumed on behalf of the caller; unused when
+	// instance is set.
+	arn string
+	// instance selects the credentials maintained by credRefreshLoop.
+	instance bool
+}
+
+// RoleResolver decides which role is served to the client of a request.
+// It returns nil if the client is not entitled to any role.
+type RoleResolver interface {
+	ResolveRole(s *Server, r *http.Request) (*servedRole, error)
+}
+
+// newRoleResolver returns the RoleResolver selected by options, or nil if
+// every caller is served the instance role.
+func newRoleResolver(options *Options) (RoleResolver, error) {
+	if options.RoleMappingFile != "" && options.PodRoleResolver != "" {
+		return nil, errors.New("-role-mapping-file and -pod-role-resolver are mutually exclusive")
+	}
+	if options.RoleMappingFile != "" {
+		return loadRoleMapping(options.RoleMappingFile, &procPeerResolver{root: "/proc"})
+	}
+
+	fallback := fallbackRole{
+		roleArn:  options.PodDefaultRoleArn,
+		instance: options.PodDefaultInstanceRole,
+	}
+	switch options.PodRoleResolver {
+	case "":
+		return nil, nil
+	case podRoleResolverFile:
+		if options.PodRoleFile == "" {
+			return nil, errors.New("the file pod role resolver requires -pod-role-file")
+		}
+		return &podRoleResolver{
+			pods:     &filePodResolver{path: options.PodRoleFile},
+			fallback: fallback,
+		}, nil
+	case podRoleResolverKubernetes:
+		pods, err := newKubePodResolver(options)
+		if err != nil {
+			return nil, err
+		}
+		return &podRoleResolver{pods: pods, fallback: fallback}, nil
+	default:
+		return nil, fmt.Errorf("unknown pod role resolver: %q", options.PodRoleResolver)
+	}
+}
+
+// resolveRole returns the role served to the client of r, or nil if the
+// client is not entitled to any role.
+func (s *Server) resolveRole(r *http.Request) (*servedRole, error) {
+	if s.roleResolver != nil {
+		return s.roleResolver.ResolveRole(s, r)
+	}
+	return s.instanceRole()
+}
+
+// instanceRole returns the role whose credentials are maintained by
+// credRefreshLoop, or nil if there is none.
+func (s *Server) instanceRole() (*servedRole, error) {
+	name, err := s.getRoleName()
+	if err != nil || name == "" {
+		return nil, err
+	}
+	s.iamMu.RLock()
+	defer s.iamMu.RUnlock()
+	return &servedRole{name: name, arn: s.iamRoleArn, instance: true}, nil
+}
+
+// fallbackRole is what a RoleResolver serves to clients it has no role
+// for: a fixed role, the instance role, or nothing.
+type fallbackRole struct {
+	roleArn  string
+	instance bool
+}
+
+func (f fallbackRole) resolve(s *Server) (*servedRole, error) {
+	switch {
+	case f.instance:
+		return s.instanceRole()
+	case f.roleArn != "":
+		return &servedRole{name: roleNameFromArn(f.roleArn), arn: f.roleArn}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// getRoleCredentials returns the current credentials of role, or nil if
+// none are available.
+func (s *Server) getRoleCredentials(role *servedRole) (*IMDSCredentials, error) {
+	if role.instance {
+		iamCreds, imdsCreds := s.getIMDSCredentials()
+		if iamCreds == nil {
+			return nil, nil
+		}
+		return imdsCreds, nil
+	}
+	return s.roleCache.get(role.arn)
+}
+
+// roleCredentialCache holds credentials for roles assumed on behalf of
+// individual clients.  Roles are assumed with the instance credentials,
+// and each role's credentials are shared by all clients mapped to it and
+// refreshed by the SDK when they are about to expire.
+type roleCredentialCache struct {
+	server *Server
+
+	mu    sync.Mutex
+	sess  *session.Session
+	roles map[string]*credentials.Credentials
+}
+
+func newRoleCredentialCache(s *Server) *roleCredentialCache {
+	return &roleCredentialCache{
+		server: s,
+		roles:  make(map[string]*credentials.Credentials),
+	}
+}
+
+func (c *roleCredentialCache) get(roleArn string) (*IMDSCredentials, error) {
+	return c.getTagged(roleArn, nil)
+}
+
+// getTagged is like get, but assumes the role with the given session tags.
+// Each distinct set of tags gets its own session.
+func (c *roleCredentialCache) getTagged(roleArn string, tags map[string]string) (*IMDSCredentials, error) {
+	if roleArn == "" {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	cacheKey := roleArn
+	stsTags := make([]*sts.Tag, 0, len(keys))
+	for _, k := range keys {
+		cacheKey += "\x00" + k + "=" + tags[k]
+		stsTags = append(stsTags, &sts.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+
+	c.mu.Lock()
+	creds, ok := c.roles[cacheKey]
+	if !ok {
+		if c.sess == nil {
+			config, err := c.server.getAWSConfig(
+				credentials.NewCredentials(&instanceRoleProvider{server: c.server}))
+			if err != nil {
+				c.mu.Unlock()
+				return nil, err
+			}
+			sess, err := session.NewSession(config)
+			if err != nil {
+				c.mu.Unlock()
+				return nil, fmt.Errorf("could not create AWS session: %w", err)
+			}
+			c.sess = sess
+		}
+		creds = stscreds.NewCredentials(c.sess, roleArn,
+			func(p *stscreds.AssumeRoleProvider) {
+				if len(stsTags) != 0 {
+					p.Tags = stsTags
+				}
+			})
+		c.roles[cacheKey] = creds
+	}
+	c.mu.Unlock()
+
+	imdsCreds, err := imdsCredentialsFrom(creds)
+	if err != nil {
+		return nil, fmt.Errorf("could not assume %s: %w", roleArn, err)
+	}
+	return imdsCreds, nil
+}
+
+// instanceRoleProvider exposes the current instance credentials, as
+// maintained by credRefreshLoop, as a credentials.Provider.  It reports
+// itself expired whenever the loop has published a new set.
+type instanceRoleProvider struct {
+	server *Server
+
+	mu   sync.Mutex
+	last *IMDSCredentials
+}
+
+func (p *instanceRoleProvider) Retrieve() (credentials.Value, error) {
+	iamCreds, imdsCreds := p.server.getIMDSCredentials()
+	if iamCreds == nil {
+		return credentials.Value{}, errors.New("no instance credentials available")
+	}
+	p.mu.Lock()
+	p.last = imdsCreds
+	p.mu.Unlock()
+	return iamCreds.Get()
+}
+
+func (p *instanceRoleProvider) IsExpired() bool {
+	iamCreds, imdsCreds := p.server.getIMDSCredentials()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return iamCreds == nil || imdsCreds != p.last || iamCreds.IsExpired()
+}
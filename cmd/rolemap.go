@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// roleMapping maps local callers, identified by the UID or systemd unit of
+// the process owning the client socket, to IAM roles.
+type roleMapping struct {
+	// DefaultRoleArn is served to callers not matching any entry.
+	DefaultRoleArn string `json:"default_role_arn"`
+	// DefaultInstanceRole serves the instance role to callers not
+	// matching any entry.  Without either default they get a 404.
+	DefaultInstanceRole bool               `json:"default_instance_role"`
+	Roles               []roleMappingEntry `json:"roles"`
+
+	peers     PeerResolver
+	needsUnit bool
+	fallback  fallbackRole
+}
+
+// roleMappingEntry is a single caller-to-role mapping.  Exactly one of
+// UID, User and Unit must be set.
+type roleMappingEntry struct {
+	UID     *int   `json:"uid,omitempty"`
+	User    string `json:"user,omitempty"`
+	Unit    string `json:"unit,omitempty"`
+	RoleArn string `json:"role_arn"`
+}
+
+func loadRoleMapping(path string, peers PeerResolver) (*roleMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &roleMapping{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("cannot parse role mapping %s: %w", path, err)
+	}
+	if err := m.init(peers); err != nil {
+		return nil, fmt.Errorf("invalid role mapping %s: %w", path, err)
+	}
+	return m, nil
+}
+
+func (m *roleMapping) init(peers PeerResolver) error {
+	m.peers = peers
+	for i := range m.Roles {
+		e := &m.Roles[i]
+		if e.RoleArn == "" {
+			return fmt.Errorf("entry %d: role_arn is required", i)
+		}
+		set := 0
+		if e.UID != nil {
+			set++
+		}
+		if e.User != "" {
+			u, err := user.Lookup(e.User)
+			if err != nil {
+				return fmt.Errorf("entry %d: %w", i, err)
+			}
+			uid, err := strconv.Atoi(u.Uid)
+			if err != nil {
+				return fmt.Errorf("entry %d: %w", i, err)
+			}
+			e.UID = &uid
+			set++
+		}
+		if e.Unit != "" {
+			m.needsUnit = true
+			set++
+		}
+		if set != 1 {
+			return fmt.Errorf("entry %d: exactly one of uid, user or unit is required", i)
+		}
+	}
+
+	if m.DefaultRoleArn != "" && m.DefaultInstanceRole {
+		return errors.New("default_role_arn and default_instance_role are mutually exclusive")
+	}
+	m.fallback = fallbackRole{roleArn: m.DefaultRoleArn, instance: m.DefaultInstanceRole}
+	return nil
+}
+
+// ResolveRole returns the role served to the client of r.
+func (m *roleMapping) ResolveRole(s *Server, r *http.Request) (*servedRole, error) {
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if localAddr != nil {
+		peer, err := m.peers.ResolvePeer(r.RemoteAddr, localAddr.String(), m.needsUnit)
+		if err != nil {
+			klog.Warningf("could not identify client %s: %v", r.RemoteAddr, err)
+		} else if e := m.match(peer); e != nil {
+			return &servedRole{name: roleNameFromArn(e.RoleArn), arn: e.RoleArn}, nil
+		}
+	}
+
+	return m.fallback.resolve(s)
+}
+
+func (m *roleMapping) match(peer *peerInfo) *roleMappingEntry {
+	for i := range m.Roles {
+		e := &m.Roles[i]
+		if e.UID != nil && *e.UID == peer.UID {
+			return e
+		}
+		if e.Unit != "" && e.Unit == peer.Unit {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// mockPeerResolver maps client addresses to fixed peers.
+type mockPeerResolver struct {
+	peers map[string]*peerInfo
+}
+
+func (m *mockPeerResolver) ResolvePeer(remoteAddr, _ string, _ bool) (*peerInfo, error) {
+	if p, ok := m.peers[remoteAddr]; ok {
+		return p, nil
+	}
+	return nil, errPeerNotFound
+}
+
+func newRoleMappingTestServer(t *testing.T, m *roleMapping) *Server {
+	t.Helper()
+	sts := httptest.NewServer(newOfflineSTS("123456789012", time.Hour).Handler())
+	t.Cleanup(sts.Close)
+
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["services"] = map[string]interface{}{
+		"endpoints": map[string]interface{}{"sts": sts.URL},
+	}
+	s := newTestServerWithIAM(t, data)
+
+	err := m.init(&mockPeerResolver{peers: map[string]*peerInfo{
+		"127.0.0.1:40001": {UID: 1001},
+		"127.0.0.1:40002": {UID: 1002, Unit: "billing.service"},
+		"127.0.0.1:40003": {UID: 1003},
+	}})
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	s.roleResolver = m
+	return s
+}
+
+func roleMappingRequest(path string, remoteAddr string) *http.Request {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remoteAddr
+	local := &net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80}
+	return req.WithContext(
+		context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+}
+
+func TestRoleMappingByUIDAndUnit(t *testing.T) {
+	uid := 1001
+	s := newRoleMappingTestServer(t, &roleMapping{
+		Roles: []roleMappingEntry{
+			{UID: &uid, RoleArn: "arn:aws:iam::123456789012:role/web"},
+			{Unit: "billing.service", RoleArn: "arn:aws:iam::123456789012:role/billing"},
+		},
+	})
+
+	tests := []struct {
+		remote string
+		role   string
+	}{
+		{"127.0.0.1:40001", "web"},
+		{"127.0.0.1:40002", "billing"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		s.iamSecurityCredentialsListHandler(w, roleMappingRequest(
+			"/latest/meta-data/iam/security-credentials", tt.remote))
+		if w.Body.String() != tt.role {
+			t.Errorf("%s: expected role %q, got %q", tt.remote, tt.role, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		s.iamSecurityCredentialsHandler(w, roleMappingRequest(
+			"/latest/meta-data/iam/security-credentials/"+tt.role, tt.remote))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tt.remote, w.Code, w.Body.String())
+		}
+		var creds IMDSCredentials
+		if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+			t.Fatalf("bad JSON: %v", err)
+		}
+		if creds.AccessKeyID == "AKIATEST" || creds.Token == "" {
+			t.Errorf("%s: expected assumed-role credentials, got %+v", tt.remote, creds)
+		}
+	}
+
+	// A caller must not be able to read another caller's role.
+	w := httptest.NewRecorder()
+	s.iamSecurityCredentialsHandler(w, roleMappingRequest(
+		"/latest/meta-data/iam/security-credentials/billing", "127.0.0.1:40001"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another caller's role, got %d", w.Code)
+	}
+}
+
+func TestRoleMappingDefaults(t *testing.T) {
+	s := newRoleMappingTestServer(t, &roleMapping{})
+	w := httptest.NewRecorder()
+	s.iamSecurityCredentialsListHandler(w, roleMappingRequest(
+		"/latest/meta-data/iam/security-credentials", "127.0.0.1:40003"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unmapped caller, got %d", w.Code)
+	}
+
+	s = newRoleMappingTestServer(t, &roleMapping{DefaultInstanceRole: true})
+	w = httptest.NewRecorder()
+	s.iamSecurityCredentialsHandler(w, roleMappingRequest(
+		"/latest/meta-data/iam/security-credentials/test-role", "127.0.0.1:40003"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected instance role for unmapped caller, got %d", w.Code)
+	}
+
+	s = newRoleMappingTestServer(t, &roleMapping{
+		DefaultRoleArn: "arn:aws:iam::123456789012:role/fallback",
+	})
+	w = httptest.NewRecorder()
+	s.iamSecurityCredentialsListHandler(w, roleMappingRequest(
+		"/latest/meta-data/iam/security-credentials", "10.0.0.9:1234"))
+	if w.Body.String() != "fallback" {
+		t.Errorf("expected fallback role, got %q", w.Body.String())
+	}
+}
+
+func TestRoleMappingValidation(t *testing.T) {
+	uid := 1
+	m := &roleMapping{Roles: []roleMappingEntry{
+		{UID: &uid, Unit: "x.service", RoleArn: "arn:aws:iam::1:role/x"},
+	}}
+	if err := m.init(&mockPeerResolver{}); err == nil {
+		t.Error("expected error for entry with both uid and unit")
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	rolesAnywhereService  = "rolesanywhere"
+	rolesAnywhereTimeFmt  = "20060102T150405Z"
+	rolesAnywhereDateFmt  = "20060102"
+	rolesAnywhereProvName = "RolesAnywhereProvider"
+)
+
+// rolesAnywhereProvider retrieves temporary credentials from the IAM Roles
+// Anywhere CreateSession API, authenticating with an X.509 certificate and
+// a SigV4-X509 request signature.
+type rolesAnywhereProvider struct {
+	credentials.Expiry
+
+	endpoint       string
+	region         string
+	trustAnchorArn string
+	profileArn     string
+	roleArn        string
+	duration       time.Duration
+
+	cert   *x509.Certificate
+	chain  []*x509.Certificate
+	signer crypto.Signer
+
+	client *http.Client
+	now    func() time.Time
+}
+
+// rolesAnywhereSessionRequest is the CreateSession request body.
+type rolesAnywhereSessionRequest struct {
+	DurationSeconds int    `json:"durationSeconds"`
+	ProfileArn      string `json:"profileArn"`
+	RoleArn         string `json:"roleArn"`
+	TrustAnchorArn  string `json:"trustAnchorArn"`
+}
+
+// rolesAnywhereSessionResponse is the subset of the CreateSession response
+// used by the emulator.
+type rolesAnywhereSessionResponse struct {
+	CredentialSet []struct {
+		Credentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      string `json:"expiration"`
+		} `json:"credentials"`
+		RoleArn string `json:"roleArn"`
+	} `json:"credentialSet"`
+}
+
+func (s *Server) newRolesAnywhereProvider() (*rolesAnywhereProvider, error) {
+	opts := s.options
+	if opts.RolesAnywhereTrustAnchorArn == "" ||
+		opts.RolesAnywhereProfileArn == "" ||
+		opts.RolesAnywhereRoleArn == "" {
+		return nil, errors.New(
+			"rolesanywhere credential source requires trust anchor, profile and role ARNs")
+	}
+
+	anchor, err := arn.Parse(opts.RolesAnywhereTrustAnchorArn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust anchor ARN: %w", err)
+	}
+
+	cert, chain, err := loadCertificateChain(opts.RolesAnywhereCertificate)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := loadPrivateKey(opts.RolesAnywherePrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("https://%s.%s.amazonaws.com", rolesAnywhereService, anchor.Region)
+	if endpointData, err := s.getEndpoints(); err != nil {
+		klog.Warningf("could not read AWS endpoints from metadata: %s", err)
+	} else if url, ok := endpointData[rolesAnywhereService]; ok {
+		endpoint = url
+	}
+	klog.Infof("AWS endpoint for %s: %s", rolesAnywhereService, endpoint)
+
+	client := http.DefaultClient
+	if s.awsHTTPClient != nil {
+		client = s.awsHTTPClient
+	}
+
+	return &rolesAnywhereProvider{
+		endpoint:       endpoint,
+		region:         anchor.Region,
+		trustAnchorArn: opts.RolesAnywhereTrustAnchorArn,
+		profileArn:     opts.RolesAnywhereProfileArn,
+		roleArn:        opts.RolesAnywhereRoleArn,
+		duration:       opts.RolesAnywhereSessionDuration,
+		cert:           cert,
+		chain:          chain,
+		signer:         signer,
+		client:         client,
+		now:            time.Now,
+	}, nil
+}
+
+// Retrieve calls CreateSession and returns the issued credentials.
+func (p *rolesAnywhereProvider) Retrieve() (credentials.Value, error) {
+	body, err := json.Marshal(rolesAnywhereSessionRequest{
+		DurationSeconds: int(p.duration.Seconds()),
+		ProfileArn:      p.profileArn,
+		RoleArn:         p.roleArn,
+		TrustAnchorArn:  p.trustAnchorArn,
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	req, err := http.NewRequest(
+		http.MethodPost, strings.TrimSuffix(p.endpoint, "/")+"/sessions",
+		bytes.NewReader(body))
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := p.sign(req, body); err != nil {
+		return credentials.Value{}, fmt.Errorf("could not sign CreateSession request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf(
+			"CreateSession failed with status %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var session rolesAnywhereSessionResponse
+	if err := json.Unmarshal(respBody, &session); err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot parse CreateSession response: %w", err)
+	}
+	if len(session.CredentialSet) == 0 {
+		return credentials.Value{}, errors.New("CreateSession returned no credentials")
+	}
+
+	c := session.CredentialSet[0].Credentials
+	expiration, err := time.Parse(time.RFC3339, c.Expiration)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid credentials expiration: %w", err)
+	}
+	p.SetExpiration(expiration, 0)
+
+	klog.Infof("obtained IAM Roles Anywhere credentials for %s", p.roleArn)
+
+	return credentials.Value{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.SessionToken,
+		ProviderName:    rolesAnywhereProvName,
+	}, nil
+}
+
+// sign adds the X.509 certificate headers and a SigV4-X509 Authorization
+// header to req.
+func (p *rolesAnywhereProvider) sign(req *http.Request, body []byte) error {
+	now := p.now().UTC()
+	amzDate := now.Format(rolesAnywhereTimeFmt)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-X509", base64.StdEncoding.EncodeToString(p.cert.Raw))
+	if len(p.chain) > 0 {
+		encoded := make([]string, 0, len(p.chain))
+		for _, c := range p.chain {
+			encoded = append(encoded, base64.StdEncoding.EncodeToString(c.Raw))
+		}
+		req.Header.Set("X-Amz-X509-Chain", strings.Join(encoded, ","))
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-date", "x-amz-x509"}
+	if len(p.chain) > 0 {
+		signedHeaders = append(signedHeaders, "x-amz-x509-chain")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		val := req.Header.Get(h)
+		if h == "host" {
+			val = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(val))
+	}
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURIPath(req.URL),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	algorithm, err := sigV4X509Algorithm(p.signer)
+	if err != nil {
+		return err
+	}
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request",
+		now.Format(rolesAnywhereDateFmt), p.region, rolesAnywhereService)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := p.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm,
+		p.cert.SerialNumber.String(),
+		scope,
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(signature),
+	))
+	return nil
+}
+
+func canonicalURIPath(u *url.URL) string {
+	if p := u.EscapedPath(); p != "" {
+		return p
+	}
+	return "/"
+}
+
+func sigV4X509Algorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "AWS4-X509-RSA-SHA256", nil
+	case *ecdsa.PublicKey:
+		return "AWS4-X509-ECDSA-SHA256", nil
+	default:
+		return "", fmt.Errorf("unsupported private key type %T", signer.Public())
+	}
+}
+
+// loadCertificateChain reads a PEM file whose first certificate is the
+// end-entity certificate and any following certificates form its chain.
+func loadCertificateChain(path string) (*x509.Certificate, []*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse certificate in %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return certs[0], certs[1:], nil
+}
+
+// loadPrivateKey reads a PKCS#8, PKCS#1 or SEC 1 PEM-encoded private key.
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse private key in %s: %w", path, err)
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported private key type %T", key)
+			}
+			return signer, nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+	return nil, fmt.Errorf("no private key found in %s", path)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// writeTestCertificate writes a self-signed ECDSA certificate and its key
+// to dir and returns their paths along with the parsed certificate.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(424242),
+		Subject:      pkix.Name{CommonName: "test-host"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert
+}
+
+func TestRolesAnywhereProviderRetrieve(t *testing.T) {
+	certPath, keyPath, cert := writeTestCertificate(t, t.TempDir())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/sessions" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+
+		var req rolesAnywhereSessionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		if req.RoleArn != "arn:aws:iam::123456789012:role/onprem" {
+			t.Errorf("unexpected roleArn %q", req.RoleArn)
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-X509-ECDSA-SHA256 Credential=424242/") {
+			t.Errorf("unexpected Authorization header %q", auth)
+		}
+		sig, err := hex.DecodeString(auth[strings.LastIndex(auth, "=")+1:])
+		if err != nil {
+			t.Fatalf("bad signature encoding: %v", err)
+		}
+
+		// Recompute the string to sign and verify it with the certificate key.
+		payloadHash := sha256.Sum256(body)
+		canonical := strings.Join([]string{
+			"POST", "/sessions", "",
+			"content-type:application/json\n" +
+				"host:" + r.Host + "\n" +
+				"x-amz-date:" + r.Header.Get("X-Amz-Date") + "\n" +
+				"x-amz-x509:" + r.Header.Get("X-Amz-X509") + "\n",
+			"content-type;host;x-amz-date;x-amz-x509",
+			hex.EncodeToString(payloadHash[:]),
+		}, "\n")
+		canonicalHash := sha256.Sum256([]byte(canonical))
+		scope := r.Header.Get("X-Amz-Date")[:8] + "/us-east-2/rolesanywhere/aws4_request"
+		digest := sha256.Sum256([]byte(strings.Join([]string{
+			"AWS4-X509-ECDSA-SHA256",
+			r.Header.Get("X-Amz-Date"),
+			scope,
+			hex.EncodeToString(canonicalHash[:]),
+		}, "\n")))
+		if !ecdsa.VerifyASN1(cert.PublicKey.(*ecdsa.PublicKey), digest[:], sig) {
+			t.Error("request signature does not verify")
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"credentialSet":[{"credentials":{` +
+			`"accessKeyId":"ASIARA","secretAccessKey":"rasecret",` +
+			`"sessionToken":"ratoken","expiration":"2099-01-01T00:00:00Z"},` +
+			`"roleArn":"arn:aws:iam::123456789012:role/onprem"}]}`))
+	}))
+	defer srv.Close()
+
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["services"] = map[string]interface{}{
+		"endpoints": map[string]interface{}{"rolesanywhere": srv.URL},
+	}
+	s := newTestServer(t, data)
+	s.options.CredentialSource = credentialSourceRolesAnywhere
+	s.options.RolesAnywhereCertificate = certPath
+	s.options.RolesAnywherePrivateKey = keyPath
+	s.options.RolesAnywhereTrustAnchorArn = "arn:aws:rolesanywhere:us-east-2:123456789012:trust-anchor/ta"
+	s.options.RolesAnywhereProfileArn = "arn:aws:rolesanywhere:us-east-2:123456789012:profile/p"
+	s.options.RolesAnywhereRoleArn = "arn:aws:iam::123456789012:role/onprem"
+	s.options.RolesAnywhereSessionDuration = time.Hour
+
+	provider, err := s.newRolesAnywhereProvider()
+	if err != nil {
+		t.Fatalf("newRolesAnywhereProvider: %v", err)
+	}
+	creds, err := refreshingFetcher(credentials.NewCredentials(provider))()
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	val, _ := creds.Get()
+	if val.AccessKeyID != "ASIARA" || val.SessionToken != "ratoken" {
+		t.Errorf("unexpected credentials: %+v", val)
+	}
+	expiresAt, err := creds.ExpiresAt()
+	if err != nil || expiresAt.Year() != 2099 {
+		t.Errorf("unexpected expiry %v (%v)", expiresAt, err)
+	}
+}
+
+func TestRolesAnywhereProviderRequiresArns(t *testing.T) {
+	s := newTestServer(t, baseTestData())
+	s.options.CredentialSource = credentialSourceRolesAnywhere
+	if _, err := s.newRolesAnywhereProvider(); err == nil {
+		t.Error("expected error for missing ARNs")
+	}
+}
+
+func TestSecurityCredentialsRoleFromArn(t *testing.T) {
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	delete(md, "iam")
+	s := newTestServerWithIAM(t, data)
+	s.options.CredentialSource = credentialSourceRolesAnywhere
+	s.iamRoleArn = "arn:aws:iam::123456789012:role/path/onprem"
+
+	req := httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	w := httptest.NewRecorder()
+	s.iamSecurityCredentialsHandler(w, req)
+	if w.Body.String() != "onprem" {
+		t.Errorf("expected role 'onprem', got %q", w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/onprem", nil)
+	w = httptest.NewRecorder()
+	s.iamSecurityCredentialsHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	vaultProvName = "VaultProvider"
+
+	vaultAuthAppRole = "approle"
+	vaultAuthCert    = "cert"
+	vaultAuthToken   = "token"
+
+	// vaultTokenExpiryWindow is how long before its expiry the Vault token
+	// is replaced by logging in again.
+	vaultTokenExpiryWindow = time.Minute
+)
+
+// vaultProvider retrieves AWS credentials from the HashiCorp Vault AWS
+// secrets engine.  Renewable leases (aws/creds) are renewed in place,
+// everything else is read again once it expires.
+type vaultProvider struct {
+	credentials.Expiry
+
+	addr      string
+	authPath  string
+	method    string
+	roleID    string
+	secretID  string
+	tokenFile string
+	credsPath string
+	client    *http.Client
+	now       func() time.Time
+
+	token       string
+	tokenExpiry time.Time
+
+	leaseID        string
+	leaseRenewable bool
+	value          credentials.Value
+}
+
+// vaultResponse is the common envelope of Vault API responses.
+type vaultResponse struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int             `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// vaultAWSCredentials is the data returned by aws/creds and aws/sts.
+type vaultAWSCredentials struct {
+	AccessKey     string `json:"access_key"`
+	SecretKey     string `json:"secret_key"`
+	SecurityToken string `json:"security_token"`
+	SessionToken  string `json:"session_token"`
+}
+
+func (s *Server) newVaultProvider() (*vaultProvider, error) {
+	opts := s.options
+	p := &vaultProvider{
+		addr:      strings.TrimSuffix(opts.VaultAddr, "/"),
+		method:    opts.VaultAuthMethod,
+		roleID:    opts.VaultRoleID,
+		tokenFile: opts.VaultTokenFile,
+		credsPath: strings.Trim(opts.VaultAWSPath, "/"),
+		now:       time.Now,
+	}
+
+	mount := opts.VaultAuthMount
+	if mount == "" {
+		mount = p.method
+	}
+	p.authPath = path.Join("auth", mount, "login")
+
+	if p.credsPath == "" {
+		return nil, errors.New("vault credential source requires -vault-aws-path")
+	}
+
+	// Fall back to the Vault settings provisioned through cloud-init.
+	if md, err := s.getMetadata("ds.meta_data.vault"); err == nil && md.DS.Vault != nil {
+		if p.addr == "" {
+			p.addr = strings.TrimSuffix(md.DS.Vault.Addr, "/")
+		}
+		if p.roleID == "" {
+			p.roleID = md.DS.Vault.AppRole.RoleID
+		}
+		p.secretID = md.DS.Vault.AppRole.SecretID
+	}
+	if p.addr == "" {
+		return nil, errors.New("vault credential source requires -vault-addr")
+	}
+
+	switch p.method {
+	case vaultAuthAppRole:
+		if opts.VaultSecretIDFile != "" {
+			secretID, err := os.ReadFile(opts.VaultSecretIDFile)
+			if err != nil {
+				return nil, err
+			}
+			p.secretID = strings.TrimSpace(string(secretID))
+		}
+		if p.roleID == "" || p.secretID == "" {
+			return nil, errors.New("vault AppRole login requires a role ID and secret ID")
+		}
+	case vaultAuthCert:
+		if opts.VaultClientCert == "" || opts.VaultClientKey == "" {
+			return nil, errors.New(
+				"vault certificate login requires -vault-client-cert and -vault-client-key")
+		}
+	case vaultAuthToken:
+		if p.tokenFile == "" {
+			return nil, errors.New("vault token login requires -vault-token-file")
+		}
+	default:
+		return nil, fmt.Errorf("unknown vault auth method: %q", p.method)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.VaultCACert != "" {
+		pem, err := os.ReadFile(opts.VaultCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.VaultCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.VaultClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.VaultClientCert, opts.VaultClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	p.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	return p, nil
+}
+
+// Retrieve returns current AWS credentials, renewing the existing lease
+// when possible.
+func (p *vaultProvider) Retrieve() (credentials.Value, error) {
+	if p.leaseRenewable && p.value.AccessKeyID != "" {
+		err := p.renewLease()
+		if err == nil {
+			return p.value, nil
+		}
+		klog.Warningf("could not renew Vault lease %s: %v", p.leaseID, err)
+	}
+
+	if err := p.ensureToken(); err != nil {
+		return credentials.Value{}, fmt.Errorf("vault login failed: %w", err)
+	}
+
+	resp, err := p.do(http.MethodGet, p.credsPath, nil)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	var data vaultAWSCredentials
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot parse Vault credentials: %w", err)
+	}
+	if data.AccessKey == "" || data.SecretKey == "" {
+		return credentials.Value{}, fmt.Errorf("vault returned no credentials at %s", p.credsPath)
+	}
+
+	token := data.SecurityToken
+	if token == "" {
+		token = data.SessionToken
+	}
+	p.value = credentials.Value{
+		AccessKeyID:     data.AccessKey,
+		SecretAccessKey: data.SecretKey,
+		SessionToken:    token,
+		ProviderName:    vaultProvName,
+	}
+	p.leaseID = resp.LeaseID
+	p.leaseRenewable = resp.Renewable
+	p.setLeaseExpiration(resp.LeaseDuration)
+
+	klog.Infof("obtained AWS credentials from Vault at %s", p.credsPath)
+	return p.value, nil
+}
+
+func (p *vaultProvider) renewLease() error {
+	if err := p.ensureToken(); err != nil {
+		return err
+	}
+	resp, err := p.do(http.MethodPut, "sys/leases/renew", map[string]interface{}{
+		"lease_id": p.leaseID,
+	})
+	if err != nil {
+		return err
+	}
+	p.leaseRenewable = resp.Renewable
+	p.setLeaseExpiration(resp.LeaseDuration)
+	klog.Infof("renewed Vault lease %s", p.leaseID)
+	return nil
+}
+
+func (p *vaultProvider) setLeaseExpiration(seconds int) {
+	p.SetExpiration(p.now().Add(time.Duration(seconds)*time.Second), 0)
+}
+
+// ensureToken logs in to Vault unless the current token is still valid.
+func (p *vaultProvider) ensureToken() error {
+	if p.method == vaultAuthToken {
+		token, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return err
+		}
+		p.token = strings.TrimSpace(string(token))
+		return nil
+	}
+
+	if p.token != "" &&
+		(p.tokenExpiry.IsZero() ||
+			p.now().Add(vaultTokenExpiryWindow).Before(p.tokenExpiry)) {
+		return nil
+	}
+
+	var body map[string]interface{}
+	if p.method == vaultAuthAppRole {
+		body = map[string]interface{}{
+			"role_id":   p.roleID,
+			"secret_id": p.secretID,
+		}
+	}
+
+	p.token = ""
+	resp, err := p.do(http.MethodPost, p.authPath, body)
+	if err != nil {
+		return err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return errors.New("vault login returned no token")
+	}
+	p.token = resp.Auth.ClientToken
+	p.tokenExpiry = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		p.tokenExpiry = p.now().Add(
+			time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	}
+	return nil
+}
+
+func (p *vaultProvider) do(
+	method string,
+	apiPath string,
+	body map[string]interface{},
+) (*vaultResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, p.addr+"/v1/"+apiPath, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("X-Vault-Token", p.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result vaultResponse
+	if resp.StatusCode/100 != 2 {
+		if resp.StatusCode == http.StatusForbidden {
+			// Force a new login on the next attempt.
+			p.tokenExpiry = p.now()
+		}
+		// Errors in front of Vault, e.g. from a proxy, are not JSON.
+		msg := vaultErrorBody(data)
+		if json.Unmarshal(data, &result) == nil && len(result.Errors) != 0 {
+			msg = strings.Join(result.Errors, "; ")
+		}
+		return nil, fmt.Errorf("vault %s %s failed with status %d: %s",
+			method, apiPath, resp.StatusCode, msg)
+	}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("cannot parse Vault response: %w", err)
+		}
+	}
+	return &result, nil
+}
+
+// maxVaultErrorBody is how much of a failed response is quoted in errors.
+const maxVaultErrorBody = 256
+
+// vaultErrorBody returns the start of a failed response body for errors.
+func vaultErrorBody(data []byte) string {
+	body := strings.TrimSpace(string(data))
+	if len(body) > maxVaultErrorBody {
+		body = body[:maxVaultErrorBody] + "..."
+	}
+	return fmt.Sprintf("%q", body)
+}
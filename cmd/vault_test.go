@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubVault is a minimal Vault API stub serving AppRole login, an AWS
+// secrets engine read and lease renewal.
+type stubVault struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	lease  bool
+	server *httptest.Server
+}
+
+func newStubVault(t *testing.T, renewable bool) *stubVault {
+	t.Helper()
+	v := &stubVault{calls: make(map[string]int), lease: renewable}
+	v.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		v.calls[r.URL.Path]++
+		v.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body) //nolint:errcheck
+			if body["role_id"] != "rid" || body["secret_id"] != "sid" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"s.tok","lease_duration":3600}}`))
+		case "/v1/aws/creds/deploy", "/v1/aws/sts/deploy":
+			if r.Header.Get("X-Vault-Token") != "s.tok" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			resp := map[string]interface{}{
+				"lease_id":       "aws/creds/deploy/l1",
+				"lease_duration": 3600,
+				"renewable":      v.lease,
+				"data": map[string]interface{}{
+					"access_key":     "AKIAVAULT",
+					"secret_key":     "vaultsecret",
+					"security_token": "vaulttoken",
+				},
+			}
+			json.NewEncoder(w).Encode(resp) //nolint:errcheck
+		case "/v1/aws/creds/proxied":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html><body>502 Bad Gateway</body></html>" + strings.Repeat(" ", 1000) + "end"))
+		case "/v1/sys/leases/renew":
+			w.Write([]byte(`{"lease_id":"aws/creds/deploy/l1","lease_duration":7200,"renewable":true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(v.server.Close)
+	return v
+}
+
+func (v *stubVault) count(path string) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.calls[path]
+}
+
+func newVaultTestServer(t *testing.T, vault *stubVault, awsPath string) *Server {
+	t.Helper()
+	data := baseTestData()
+	md := data["ds"].(map[string]interface{})["meta_data"].(map[string]interface{})
+	md["vault"] = map[string]interface{}{
+		"addr": vault.server.URL,
+		"approle": map[string]interface{}{
+			"role_id":   "rid",
+			"secret_id": "sid",
+		},
+	}
+	s := newTestServer(t, data)
+	s.options.CredentialSource = credentialSourceVault
+	s.options.VaultAuthMethod = vaultAuthAppRole
+	s.options.VaultAWSPath = awsPath
+	return s
+}
+
+func TestVaultProviderRenewsLease(t *testing.T) {
+	vault := newStubVault(t, true)
+	s := newVaultTestServer(t, vault, "aws/creds/deploy")
+
+	provider, err := s.newVaultProvider()
+	if err != nil {
+		t.Fatalf("newVaultProvider: %v", err)
+	}
+
+	val, err := provider.Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	if val.AccessKeyID != "AKIAVAULT" || val.SessionToken != "vaulttoken" {
+		t.Errorf("unexpected credentials: %+v", val)
+	}
+
+	if _, err := provider.Retrieve(); err != nil {
+		t.Fatalf("second Retrieve: %v", err)
+	}
+	if got := vault.count("/v1/aws/creds/deploy"); got != 1 {
+		t.Errorf("expected 1 credentials read, got %d", got)
+	}
+	if got := vault.count("/v1/sys/leases/renew"); got != 1 {
+		t.Errorf("expected 1 lease renewal, got %d", got)
+	}
+	if got := vault.count("/v1/auth/approle/login"); got != 1 {
+		t.Errorf("expected 1 login, got %d", got)
+	}
+}
+
+func TestVaultProviderRereadsSTSCredentials(t *testing.T) {
+	vault := newStubVault(t, false)
+	s := newVaultTestServer(t, vault, "aws/sts/deploy")
+
+	provider, err := s.newVaultProvider()
+	if err != nil {
+		t.Fatalf("newVaultProvider: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := provider.Retrieve(); err != nil {
+			t.Fatalf("Retrieve: %v", err)
+		}
+	}
+	if got := vault.count("/v1/aws/sts/deploy"); got != 2 {
+		t.Errorf("expected 2 credentials reads, got %d", got)
+	}
+	if got := vault.count("/v1/sys/leases/renew"); got != 0 {
+		t.Errorf("expected no lease renewals, got %d", got)
+	}
+}
+
+func TestVaultProviderRequiresPath(t *testing.T) {
+	vault := newStubVault(t, false)
+	s := newVaultTestServer(t, vault, "")
+	if _, err := s.newVaultProvider(); err == nil {
+		t.Error("expected error without -vault-aws-path")
+	}
+}
+
+func TestVaultProviderErrorStatus(t *testing.T) {
+	vault := newStubVault(t, false)
+	s := newVaultTestServer(t, vault, "aws/creds/proxied")
+
+	provider, err := s.newVaultProvider()
+	if err != nil {
+		t.Fatalf("newVaultProvider: %v", err)
+	}
+	_, err = provider.Retrieve()
+	if err == nil || !strings.Contains(err.Error(), "status 502") ||
+		!strings.Contains(err.Error(), "502 Bad Gateway") {
+		t.Fatalf("expected the status and body in the error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "end") {
+		t.Errorf("expected the body to be truncated, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// watchDir calls onChange with the path of every file in dir that is
+// closed after writing, renamed into or out of dir, or deleted, until the
+// returned io.Closer is closed.  onChange is called with dir itself when
+// events were lost, and with an empty path once the watch has ended,
+// either because it was closed or because dir was removed.
+func watchDir(dir string, onChange func(path string)) (io.Closer, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		syscall.Close(fd)
+		return nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+
+	// A non-blocking descriptor is handled by the runtime poller, so
+	// closing the file interrupts the pending read.
+	f := os.NewFile(uintptr(fd), "inotify")
+	go readInotifyEvents(f, dir, onChange)
+	return f, nil
+}
+
+func readInotifyEvents(f *os.File, dir string, onChange func(path string)) {
+	defer onChange("")
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			// struct inotify_event { int wd; u32 mask, cookie, len; char name[]; }
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+nameLen]
+			off += syscall.SizeofInotifyEvent + nameLen
+
+			switch {
+			case mask&syscall.IN_Q_OVERFLOW != 0:
+				onChange(dir)
+			case mask&syscall.IN_IGNORED != 0:
+				return
+			case nameLen > 0:
+				onChange(filepath.Join(dir, strings.TrimRight(string(name), "\x00")))
+			}
+		}
+	}
+}
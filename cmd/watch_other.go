@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// watchDir is only implemented with inotify; elsewhere callers fall back
+// to checking files on use.
+func watchDir(dir string, onChange func(path string)) (io.Closer, error) {
+	return nil, errors.New("watching files is not supported on this platform")
+}
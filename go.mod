@@ -4,13 +4,14 @@ go 1.24
 
 require (
 	github.com/aws/aws-sdk-go v1.44.267
+	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.18.19
+	github.com/jmespath/go-jmespath v0.4.0
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/klog/v2 v2.60.1
 )
 
 require (
 	github.com/aws/aws-sdk-go-v2 v1.41.3 // indirect
-	github.com/aws/aws-sdk-go-v2/feature/ec2/imds v1.18.19 // indirect
 	github.com/aws/smithy-go v1.24.2 // indirect
 	github.com/go-logr/logr v1.2.3 // indirect
-	github.com/jmespath/go-jmespath v0.4.0 // indirect
 )